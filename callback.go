@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// Header carrying the HMAC-SHA256 of the callback body, "sha256=<hex>"
+const callbackSignatureHeader = "X-Signature-256"
+
+// Shared secret callbacks are signed with, callbacks are refused without it
+func getCallbackSecret() string {
+	return handleEnvVariables("CALLBACK_SECRET")
+}
+
+// Callbacks go over https unless CALLBACK_ALLOW_HTTP is true, e.g. for local development
+func callbackHTTPAllowed() bool {
+
+	allowed, err := strconv.ParseBool(handleEnvVariables("CALLBACK_ALLOW_HTTP"))
+
+	return err == nil && allowed
+}
+
+// Only absolute https URLs, or http ones when allowed, on public hosts can receive callbacks
+func validCallbackURL(callbackUrl string) bool {
+
+	parsed, err := url.Parse(callbackUrl)
+	if err != nil || checkPublicURL(parsed) != nil {
+		return false
+	}
+
+	return parsed.Scheme == "https" || callbackHTTPAllowed()
+}
+
+// Hex HMAC-SHA256 of a payload as "sha256=<hex>", the other side recomputes it with
+// the shared secret. Signs callbacks and checks signed requests.
+func signPayload(body []byte, secret string) string {
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// POST the finished job to its callback URL, retried a few times on network
+// errors and non-2xx responses
+func sendCallback(callbackUrl string, requestID string, job asyncJob) {
+
+	body, err := json.Marshal(job.response())
+	if err != nil {
+		logError("Error while encoding callback", logFields{"request_id": requestID, "job_id": job.id, "error": err.Error()})
+		return
+	}
+
+	signature := signPayload(body, getCallbackSecret())
+
+	for attempt := 1; attempt <= 3; attempt++ {
+		if err = postCallback(callbackUrl, job.id, body, signature); err == nil {
+			return
+		}
+
+		if attempt < 3 {
+			time.Sleep(time.Duration(attempt) * time.Second)
+		}
+	}
+
+	logError("Callback failed", logFields{"request_id": requestID, "job_id": job.id, "callback_url": callbackUrl, "error": err.Error()})
+}
+
+func postCallback(callbackUrl string, jobID string, body []byte, signature string) error {
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, callbackUrl, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("X-Job-ID", jobID)
+	request.Header.Set(callbackSignatureHeader, signature)
+
+	// The host is resolved again when connecting, so the dialer guard is what keeps
+	// callbacks away from internal addresses
+	response, err := publicHTTPClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return fmt.Errorf("callback: unexpected status %s", response.Status)
+	}
+
+	return nil
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"gopkg.in/gographics/imagick.v2/imagick"
+)
+
+// Request options understood by the optimize endpoints
+var imageOptionNames = []string{
+	"format", "quality", "webp_quality", "lossless", "width", "height", "allow_upscale",
+	"crop_width", "crop_height", "gravity", "background", "density", "effort", "sharpen",
+	"colorspace", "preserve_colorspace", "icc_profile", "strip_metadata", "chroma_subsampling",
+	"quality_preset",
+}
+
+// Formats the linked ImageMagick can read or write, by ImageMagick name (JPEG, WEBP, ...)
+var imageMagickFormats []string
+
+// Output formats of the API the linked ImageMagick can encode
+var availableFormats = map[string]bool{}
+
+// Returned when the output format's delegate (libwebp, libheif, ...) isn't in the ImageMagick build
+var ErrFormatUnavailable = errors.New("output format is not supported by this ImageMagick build")
+
+// Look up the formats once at startup, after imagick.Initialize. A base image missing
+// a delegate is logged here instead of failing on the first request.
+func configFormats() {
+
+	mw := imagick.NewMagickWand()
+	defer mw.Destroy()
+
+	imageMagickFormats = mw.QueryFormats("*")
+
+	for _, format := range availableOutputFormats(imageMagickFormats) {
+		availableFormats[format] = true
+	}
+
+	for format := range supportedFormats {
+		if !availableFormats[format] {
+			logError("ImageMagick delegate missing, output format disabled", logFields{"format": format})
+		}
+	}
+}
+
+// Output formats of the API backed by a delegate in the linked ImageMagick
+func availableOutputFormats(compiled []string) []string {
+
+	found := map[string]bool{}
+
+	for _, format := range compiled {
+		found[strings.ToUpper(format)] = true
+	}
+
+	var formats []string
+
+	for format := range supportedFormats {
+		if found[strings.ToUpper(format)] {
+			formats = append(formats, format)
+		}
+	}
+
+	sort.Strings(formats)
+
+	return formats
+}
+
+// Report the formats and options this deployment supports, so clients can check requests up front
+func Capabilities(c *gin.Context) {
+
+	version, _ := imagick.GetVersion()
+
+	var outputFormats []string
+
+	for format := range availableFormats {
+		outputFormats = append(outputFormats, format)
+	}
+
+	sort.Strings(outputFormats)
+
+	var subsamplings []string
+
+	for subsampling := range chromaSubsamplings {
+		subsamplings = append(subsamplings, subsampling)
+	}
+
+	sort.Strings(subsamplings)
+
+	var gravities []string
+
+	for gravity := range cropGravities {
+		gravities = append(gravities, gravity)
+	}
+
+	sort.Strings(gravities)
+
+	c.JSON(http.StatusOK, gin.H{
+		"imagemagick_version": version,
+		"input_formats":       imageMagickFormats,
+		"output_formats":      append(outputFormats, "original"),
+		"options":             imageOptionNames,
+		"chroma_subsampling":  subsamplings,
+		"gravities":           append(gravities, "smart"),
+		"max_download_bytes":  getMaxDownloadBytes(),
+		"max_pixel_area":      getMaxPixelArea(),
+	})
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Split a comma-separated setting, dropping empty entries
+func splitList(value string) []string {
+
+	var items []string
+
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+
+	return items
+}
+
+// Origins allowed to call the API from a browser, unset disables CORS
+func getCORSAllowedOrigins() []string {
+	return splitList(handleEnvVariables("CORS_ALLOWED_ORIGINS"))
+}
+
+func getCORSAllowedMethods() string {
+
+	methods := splitList(handleEnvVariables("CORS_ALLOWED_METHODS"))
+
+	if len(methods) == 0 {
+		methods = []string{http.MethodGet, http.MethodPost, http.MethodOptions}
+	}
+
+	return strings.Join(methods, ", ")
+}
+
+// Request headers browsers may send, the token headers are always allowed
+func getCORSAllowedHeaders() string {
+
+	headers := splitList(handleEnvVariables("CORS_ALLOWED_HEADERS"))
+
+	if len(headers) == 0 {
+		headers = []string{
+			"Content-Type", idempotencyKeyHeader, requestIDHeader, "X-Debug",
+			requestSignatureHeader, requestTimestampHeader, requestNonceHeader,
+		}
+	}
+
+	return strings.Join(append([]string{"token", "Authorization"}, headers...), ", ")
+}
+
+// Answer CORS preflights and tag responses for allowed origins, preflights carry
+// no token so this runs before APITokenMiddleware
+func CORSMiddleware() gin.HandlerFunc {
+
+	origins := getCORSAllowedOrigins()
+
+	if len(origins) == 0 {
+		return func(c *gin.Context) {
+			c.Next()
+		}
+	}
+
+	allowed := map[string]bool{}
+
+	for _, origin := range origins {
+		allowed[origin] = true
+	}
+
+	methods := getCORSAllowedMethods()
+	headers := getCORSAllowedHeaders()
+
+	return func(c *gin.Context) {
+
+		origin := c.Request.Header.Get("Origin")
+
+		if origin == "" || (!allowed["*"] && !allowed[origin]) {
+			c.Next()
+			return
+		}
+
+		c.Header("Access-Control-Allow-Origin", origin)
+		c.Header("Access-Control-Expose-Headers", requestIDHeader+", Idempotent-Replayed, Retry-After")
+		c.Header("Vary", "Origin")
+
+		if c.Request.Method == http.MethodOptions && c.Request.Header.Get("Access-Control-Request-Method") != "" {
+			c.Header("Access-Control-Allow-Methods", methods)
+			c.Header("Access-Control-Allow-Headers", headers)
+			c.Header("Access-Control-Max-Age", "600")
+			c.AbortWithStatus(http.StatusNoContent)
+			return
+		}
+
+		c.Next()
+	}
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Header clients set to make retries of the same request safe
+const idempotencyKeyHeader = "Idempotency-Key"
+
+// Response recorded for an Idempotency-Key, replayed when the key comes back
+type idempotentResponse struct {
+	done        bool
+	requestHash [sha256.Size]byte
+	status      int
+	contentType string
+	location    string
+	body        []byte
+	expires     time.Time
+}
+
+// In-memory responses by client, path and Idempotency-Key, bounded by entry
+// count and by the total size of the recorded bodies
+type idempotencyStore struct {
+	mutex      sync.Mutex
+	entries    map[string]*idempotentResponse
+	maxEntries int
+	maxBytes   int
+	bytes      int
+}
+
+// Claim a key, returns the existing entry when the key was already seen. Nothing
+// is claimed when the store is full of requests still processing.
+func (store *idempotencyStore) begin(key string, requestHash [sha256.Size]byte, ttl time.Duration) (*idempotentResponse, bool) {
+
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	if entry, found := store.entries[key]; found && time.Now().Before(entry.expires) {
+		copied := *entry
+		return &copied, true
+	}
+
+	store.remove(key)
+
+	if len(store.entries) >= store.maxEntries && !store.evictOldest() {
+		return nil, false
+	}
+
+	store.entries[key] = &idempotentResponse{requestHash: requestHash, expires: time.Now().Add(ttl)}
+
+	return nil, false
+}
+
+// Record the response, it's dropped when its body alone is over the byte limit
+func (store *idempotencyStore) finish(key string, status int, contentType string, location string, body []byte) {
+
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	entry, found := store.entries[key]
+	if !found {
+		return
+	}
+
+	if len(body) > store.maxBytes {
+		store.remove(key)
+		return
+	}
+
+	for store.bytes+len(body) > store.maxBytes {
+		if !store.evictOldest() {
+			break
+		}
+	}
+
+	entry.done = true
+	entry.status = status
+	entry.contentType = contentType
+	entry.location = location
+	entry.body = body
+	store.bytes += len(body)
+}
+
+func (store *idempotencyStore) forget(key string) {
+
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	store.remove(key)
+}
+
+// Delete an entry and its share of the byte count, the mutex must be held
+func (store *idempotencyStore) remove(key string) {
+
+	if entry, found := store.entries[key]; found {
+		store.bytes -= len(entry.body)
+		delete(store.entries, key)
+	}
+}
+
+// Drop the finished entry closest to expiring, false when every entry is still
+// processing. The mutex must be held.
+func (store *idempotencyStore) evictOldest() bool {
+
+	oldest := ""
+	var oldestExpires time.Time
+
+	for key, entry := range store.entries {
+		if entry.done && (oldest == "" || entry.expires.Before(oldestExpires)) {
+			oldest, oldestExpires = key, entry.expires
+		}
+	}
+
+	if oldest == "" {
+		return false
+	}
+
+	store.remove(oldest)
+
+	return true
+}
+
+func (store *idempotencyStore) removeExpired() {
+
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	now := time.Now()
+
+	for key, entry := range store.entries {
+		if now.After(entry.expires) {
+			store.remove(key)
+		}
+	}
+}
+
+// Only JSON responses are kept, images returned inline would fill the store
+func replayableContentType(contentType string) bool {
+	return strings.HasPrefix(contentType, "application/json")
+}
+
+// Keeps a copy of the JSON body written by the handlers
+type bodyRecorder struct {
+	gin.ResponseWriter
+	body *bytes.Buffer
+}
+
+func (w bodyRecorder) Write(b []byte) (int, error) {
+
+	if replayableContentType(w.Header().Get("Content-Type")) {
+		w.body.Write(b)
+	}
+
+	return w.ResponseWriter.Write(b)
+}
+
+func (w bodyRecorder) WriteString(s string) (int, error) {
+
+	if replayableContentType(w.Header().Get("Content-Type")) {
+		w.body.WriteString(s)
+	}
+
+	return w.ResponseWriter.WriteString(s)
+}
+
+// How long responses are kept for replay, 24 hours by default
+func getIdempotencyTTL() time.Duration {
+	return time.Duration(handleIntEnvVariable("IDEMPOTENCY_TTL_SECONDS", 24*60*60)) * time.Second
+}
+
+// Keys remembered at once, 10000 by default
+func getIdempotencyMaxEntries() int {
+	return int(handleIntEnvVariable("IDEMPOTENCY_MAX_ENTRIES", 10000))
+}
+
+// Total size of the responses kept for replay, 64MB by default
+func getIdempotencyMaxBytes() int {
+	return int(handleIntEnvVariable("IDEMPOTENCY_MAX_BYTES", 64*1024*1024))
+}
+
+// Replay the original response when a request repeats an Idempotency-Key instead of
+// processing the image again. Server errors and non-JSON responses aren't kept, so
+// those can be retried, and a key reused with a different body is refused with 422.
+func IdempotencyMiddleware() gin.HandlerFunc {
+
+	store := &idempotencyStore{
+		entries:    map[string]*idempotentResponse{},
+		maxEntries: getIdempotencyMaxEntries(),
+		maxBytes:   getIdempotencyMaxBytes(),
+	}
+	ttl := getIdempotencyTTL()
+
+	go func() {
+		for range time.Tick(time.Minute) {
+			store.removeExpired()
+		}
+	}()
+
+	return func(c *gin.Context) {
+
+		idempotencyKey := c.Request.Header.Get(idempotencyKeyHeader)
+
+		if idempotencyKey == "" {
+			c.Next()
+			return
+		}
+
+		if len(idempotencyKey) > 255 {
+			respondWithError(c, http.StatusBadRequest, "Idempotency-Key must be at most 255 characters")
+			return
+		}
+
+		// Keys are scoped to the client token so two clients can't see each other's responses
+		key := requestToken(c) + "\x00" + c.Request.URL.Path + "\x00" + idempotencyKey
+
+		// Bounded by the route's body limit, which runs first
+		body, err := io.ReadAll(c.Request.Body)
+		if err != nil {
+			respondWithError(c, bindErrorStatus(err), err.Error())
+			return
+		}
+
+		c.Request.Body = io.NopCloser(bytes.NewReader(body))
+
+		requestHash := sha256.Sum256(body)
+
+		entry, found := store.begin(key, requestHash, ttl)
+
+		if found && entry.requestHash != requestHash {
+			respondWithError(c, http.StatusUnprocessableEntity, "Idempotency-Key was already used with a different request body")
+			return
+		}
+
+		if found && !entry.done {
+			respondWithError(c, http.StatusConflict, "A request with this Idempotency-Key is still being processed")
+			return
+		}
+
+		if found {
+			c.Header("Idempotent-Replayed", "true")
+
+			if entry.location != "" {
+				c.Header("Location", entry.location)
+			}
+
+			c.Data(entry.status, entry.contentType, entry.body)
+			c.Abort()
+			return
+		}
+
+		recorder := bodyRecorder{ResponseWriter: c.Writer, body: &bytes.Buffer{}}
+		c.Writer = recorder
+
+		// A panicking handler must not leave the key claimed until it expires
+		defer func() {
+			if recovered := recover(); recovered != nil {
+				store.forget(key)
+				panic(recovered)
+			}
+		}()
+
+		c.Next()
+
+		if recorder.Status() >= http.StatusInternalServerError || !replayableContentType(recorder.Header().Get("Content-Type")) {
+			store.forget(key)
+			return
+		}
+
+		store.finish(key, recorder.Status(), recorder.Header().Get("Content-Type"), recorder.Header().Get("Location"), recorder.body.Bytes())
+	}
+}
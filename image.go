@@ -0,0 +1,540 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"runtime/debug"
+	"strconv"
+	"strings"
+
+	"gopkg.in/gographics/imagick.v2/imagick"
+)
+
+// Target colorspaces accepted in the request
+var colorspaces = map[string]imagick.ColorspaceType{
+	"srgb": imagick.COLORSPACE_SRGB,
+	"gray": imagick.COLORSPACE_GRAY,
+	"cmyk": imagick.COLORSPACE_CMYK,
+}
+
+// ImageMagick resource limit read from an env var, in units of unit bytes or pixels
+type resourceLimit struct {
+	key      string
+	resource imagick.ResourceType
+	unit     uint64
+	fallback int64
+}
+
+// Pixels past the memory limit go to memory-mapped files, then to disk under
+// MAGICK_TEMPORARY_PATH up to the disk limit, so an enormous image fails instead of
+// running the process out of memory or filling the disk. Width and height are
+// refused while decoding, before a crafted image can allocate its pixels: no side
+// can be longer than MAX_PIXEL_AREA allows, and never past 32768.
+func resourceLimits() []resourceLimit {
+
+	maxSide := getMaxPixelArea()
+
+	if maxSide > 32768 {
+		maxSide = 32768
+	}
+
+	return []resourceLimit{
+		{"IMAGEMAGICK_MEMORY_LIMIT_MB", imagick.RESOURCE_MEMORY, 1024 * 1024, 0},
+		{"IMAGEMAGICK_MAP_LIMIT_MB", imagick.RESOURCE_MAP, 1024 * 1024, 0},
+		{"IMAGEMAGICK_DISK_LIMIT_MB", imagick.RESOURCE_DISK, 1024 * 1024, 2048},
+		{"IMAGEMAGICK_AREA_LIMIT", imagick.RESOURCE_AREA, 1, getMaxPixelArea()},
+		{"IMAGEMAGICK_WIDTH_LIMIT", imagick.RESOURCE_WIDTH, 1, maxSide},
+		{"IMAGEMAGICK_HEIGHT_LIMIT", imagick.RESOURCE_HEIGHT, 1, maxSide},
+	}
+}
+
+// Apply the resource limits once at startup, after imagick.Initialize. Limits
+// without a default keep ImageMagick's own when unset.
+func configResourceLimits() {
+
+	for _, limit := range resourceLimits() {
+		value := handleIntEnvVariable(limit.key, limit.fallback)
+
+		if value == 0 {
+			continue
+		}
+
+		if !imagick.SetResourceLimit(limit.resource, uint64(value)*limit.unit) {
+			logError("Error while setting ImageMagick resource limit", logFields{"limit": limit.key, "value": value})
+		}
+	}
+}
+
+// Metadata of an image optimized by OptimizeBytes
+type ImageInfo struct {
+	Width       uint
+	Height      uint
+	InputFormat string
+	Format      string
+}
+
+// Optimize raw image bytes with the same pipeline and defaults as the endpoints,
+// without any HTTP or S3. imagick.Initialize and configFormats must have run.
+func OptimizeBytes(in []byte, opts ImageOptions) ([]byte, ImageInfo, error) {
+
+	options, err := opts.optimizeOptions()
+	if err != nil {
+		return nil, ImageInfo{}, err
+	}
+
+	processed, _, err := processImage(in, options)
+	if err != nil {
+		return nil, ImageInfo{}, err
+	}
+
+	info := ImageInfo{
+		Width:       processed.width,
+		Height:      processed.height,
+		InputFormat: processed.inputFormat,
+		Format:      processed.format,
+	}
+
+	return processed.blob, info, nil
+}
+
+// Encoded output of the ImageMagick pipeline
+type processedImage struct {
+	blob        []byte
+	width       uint
+	height      uint
+	inputFormat string
+
+	// Output format, the input's own when the request kept the original
+	format string
+}
+
+// Returned when ImageMagick panics on an input, the panic is logged with its stack
+var ErrProcessingPanic = errors.New("image processing failed unexpectedly")
+
+// Returned when the source isn't an image ImageMagick can decode, like a text file or a PDF
+var ErrNotAnImage = errors.New("source is not a supported image")
+
+// Document and text formats ImageMagick can read but that aren't images to optimize
+var documentFormats = map[string]bool{
+	"PDF":  true,
+	"PS":   true,
+	"EPS":  true,
+	"EPSF": true,
+	"AI":   true,
+	"TXT":  true,
+	"TEXT": true,
+}
+
+// Run the ImageMagick pipeline on raw image bytes
+func processImage(fileBytes []byte, options optimizeOptions) (processed processedImage, code int, err error) {
+
+	mw := imagick.NewMagickWand()
+
+	// The wand is destroyed however processing ends, including a panic on a
+	// malformed input. Async jobs and prefix workers run outside the recovery
+	// middleware, so the panic is turned into an error here.
+	defer func() {
+		mw.Destroy()
+
+		if recovered := recover(); recovered != nil {
+			logError("Panic while processing image", logFields{"panic": fmt.Sprint(recovered), "stack": string(debug.Stack())})
+			processed, code, err = processedImage{}, http.StatusInternalServerError, ErrProcessingPanic
+		}
+	}()
+
+	// Pinging reads the headers only, so a small file declaring huge or countless
+	// frames is refused before any pixels are decoded
+	if code, err := pingImage(fileBytes); err != nil {
+		return processedImage{}, code, err
+	}
+
+	if err := mw.ReadImageBlob(fileBytes); err != nil {
+		code, err := readError(err)
+		return processedImage{}, code, err
+	}
+
+	inputFormat := strings.ToUpper(mw.GetImageFormat())
+
+	if documentFormats[inputFormat] {
+		return processedImage{}, http.StatusUnsupportedMediaType, fmt.Errorf("%w: %s", ErrNotAnImage, strings.ToLower(inputFormat))
+	}
+
+	if options.format == "" {
+		options.format = originalFormats[inputFormat]
+
+		if options.format == "" {
+			options.format = "jpeg"
+		}
+	}
+
+	// Checked before encoding, so the source is never deleted for an output that can't be written
+	if !availableFormats[options.format] {
+		return processedImage{}, http.StatusNotImplemented, fmt.Errorf("%w: %s", ErrFormatUnavailable, options.format)
+	}
+
+	// Checked again on the decoded images, every frame counts and coalescing would
+	// allocate them all at the full canvas size
+	if pixelArea(mw) > getMaxPixelArea() {
+		return processedImage{}, http.StatusRequestEntityTooLarge, ErrImageTooLarge
+	}
+
+	// Animated GIFs keep every frame when converted to WebP, coalesced so each frame
+	// is a full image. Other multi-image inputs (TIFF pages, HEIC sequences, GIFs to
+	// still formats) leave the wand on their last image, so the first one is kept.
+	animated := mw.GetNumberImages() > 1 && inputFormat == "GIF" && options.format == "webp"
+
+	if animated {
+		// The deferred Destroy reads mw when it runs, so it frees the coalesced wand
+		coalesced := mw.CoalesceImages()
+		mw.Destroy()
+		mw = coalesced
+		mw.ResetIterator()
+
+		for mw.NextImage() {
+			if err := processFrame(mw, options); err != nil {
+				return processedImage{}, http.StatusInternalServerError, err
+			}
+		}
+	} else {
+		mw.SetIteratorIndex(0)
+
+		if err := processFrame(mw, options); err != nil {
+			return processedImage{}, http.StatusInternalServerError, err
+		}
+	}
+
+	processed = processedImage{
+		width:       mw.GetImageWidth(),
+		height:      mw.GetImageHeight(),
+		inputFormat: inputFormat,
+		format:      options.format,
+	}
+
+	if animated {
+		processed.blob = mw.GetImagesBlob()
+	} else {
+		processed.blob = mw.GetImageBlob()
+	}
+
+	return processed, http.StatusOK, nil
+}
+
+// Check the dimensions and frame count from the image headers against MAX_PIXEL_AREA
+func pingImage(fileBytes []byte) (int, error) {
+
+	pinged := imagick.NewMagickWand()
+	defer pinged.Destroy()
+
+	if err := pinged.PingImageBlob(fileBytes); err != nil {
+		return readError(err)
+	}
+
+	if pixelArea(pinged) > getMaxPixelArea() {
+		return http.StatusRequestEntityTooLarge, ErrImageTooLarge
+	}
+
+	return http.StatusOK, nil
+}
+
+// Pixels held once every frame is decoded at the size of the largest one, which is
+// what coalescing an animation allocates
+func pixelArea(mw *imagick.MagickWand) int64 {
+
+	var width, height uint
+
+	for i := 0; i < int(mw.GetNumberImages()); i++ {
+		mw.SetIteratorIndex(i)
+
+		if w := mw.GetImageWidth(); w > width {
+			width = w
+		}
+
+		if h := mw.GetImageHeight(); h > height {
+			height = h
+		}
+
+		if w, h, _, _, err := mw.GetImagePage(); err == nil {
+			if w > width {
+				width = w
+			}
+
+			if h > height {
+				height = h
+			}
+		}
+	}
+
+	return int64(width) * int64(height) * int64(mw.GetNumberImages())
+}
+
+// ImageMagick finds no decoder ("delegate") for bytes that aren't an image and
+// refuses images past the resource limits, other read failures (e.g. a truncated
+// file of a known format) stay server errors
+func readError(err error) (int, error) {
+
+	if strings.Contains(err.Error(), "no decode delegate") {
+		return http.StatusUnsupportedMediaType, ErrNotAnImage
+	}
+
+	if strings.Contains(err.Error(), "exceeds limit") || strings.Contains(err.Error(), "cache resources exhausted") {
+		return http.StatusRequestEntityTooLarge, ErrImageTooLarge
+	}
+
+	return http.StatusInternalServerError, err
+}
+
+// Quality for the resolved output format, webp_quality then quality then the format's default
+func (options optimizeOptions) outputQuality() uint {
+
+	if options.format == "webp" && options.webpQuality > 0 {
+		return options.webpQuality
+	}
+
+	if options.quality > 0 {
+		return options.quality
+	}
+
+	return getDefaultQuality(options.format)
+}
+
+// Resize and re-encode the current image of the wand
+func processFrame(mw *imagick.MagickWand, options optimizeOptions) error {
+
+	// Rotate the pixels to match the EXIF orientation first, stripping drops the
+	// tag and resizing needs the final width and height
+	if err := mw.AutoOrientImage(); err != nil {
+		return err
+	}
+
+	if options.cropWidth > 0 || options.cropHeight > 0 {
+		if err := cropImage(mw, options); err != nil {
+			return err
+		}
+	}
+
+	width, height := options.width, options.height
+
+	if width > 0 || height > 0 {
+		originalWidth := mw.GetImageWidth()
+		originalHeight := mw.GetImageHeight()
+
+		if width == 0 {
+			width = originalWidth * height / originalHeight
+		}
+
+		if height == 0 {
+			height = originalHeight * width / originalWidth
+		}
+
+		// Upscaling only makes files bigger and blurrier, so the target is scaled
+		// down to fit the source unless allow_upscale is set
+		if !options.allowUpscale && (width > originalWidth || height > originalHeight) {
+			scale := math.Min(float64(originalWidth)/float64(width), float64(originalHeight)/float64(height))
+			width = uint(math.Round(float64(width) * scale))
+			height = uint(math.Round(float64(height) * scale))
+		}
+
+		if width < 1 {
+			width = 1
+		}
+
+		if height < 1 {
+			height = 1
+		}
+
+		if err := mw.ResizeImage(width, height, imagick.FILTER_LANCZOS, 1); err != nil {
+			return err
+		}
+	}
+
+	// Downscaling softens edges, a radius of 0 lets ImageMagick pick one from the sigma
+	if options.sharpen > 0 {
+		if err := mw.UnsharpMaskImage(0, options.sharpen, 1, 0.05); err != nil {
+			return err
+		}
+	}
+
+	mw.SetSamplingFactors(options.samplingFactors)
+
+	// Color conversion goes before stripping, the ICC transform needs the source's
+	// embedded profile. Converting (rather than relabeling) keeps CMYK sources' colors.
+	// A requested profile is the only conversion, a colorspace transform after it
+	// would move the pixels out of the profile's space again.
+	if options.iccProfile != nil {
+		if err := mw.ProfileImage("icc", options.iccProfile); err != nil {
+			return err
+		}
+	} else if !options.keepColorspace {
+		if err := mw.TransformImageColorspace(colorspaces[options.colorspace]); err != nil {
+			return err
+		}
+	}
+
+	// Stripping drops every profile, the requested one is embedded again so viewers
+	// read the converted pixels with it. Without a source profile ImageMagick only
+	// attaches it.
+	if options.stripMetadata {
+		mw.StripImage()
+
+		if options.iccProfile != nil {
+			if err := mw.ProfileImage("icc", options.iccProfile); err != nil {
+				return err
+			}
+		}
+	}
+
+	// Interlacing follows the output, the source's own scheme would otherwise carry over.
+	// JPEG is progressive so above-the-fold images render early on slow connections, PNG
+	// uses Adam7, and WebP and AVIF have no interlacing. GIF sources are written as PNG.
+	switch options.format {
+	case "jpeg":
+		mw.SetImageInterlaceScheme(imagick.INTERLACE_PLANE)
+	case "png":
+		mw.SetImageInterlaceScheme(imagick.INTERLACE_PNG)
+	default:
+		mw.SetImageInterlaceScheme(imagick.INTERLACE_NO)
+	}
+
+	if options.density > 0 {
+		if err := mw.SetImageUnits(imagick.RESOLUTION_PIXELS_PER_INCH); err != nil {
+			return err
+		}
+
+		if err := mw.SetImageResolution(float64(options.density), float64(options.density)); err != nil {
+			return err
+		}
+	}
+
+	// Transparent pixels would turn black in formats without alpha, flatten them onto the background
+	if !supportedFormats[options.format].alpha && mw.GetImageAlphaChannel() {
+		background := imagick.NewPixelWand()
+		defer background.Destroy()
+
+		if !background.SetColor(options.background) {
+			return fmt.Errorf("unknown background color %q", options.background)
+		}
+
+		if err := mw.SetImageBackgroundColor(background); err != nil {
+			return err
+		}
+
+		if err := mw.SetImageAlphaChannel(imagick.ALPHA_CHANNEL_REMOVE); err != nil {
+			return err
+		}
+	}
+
+	if err := mw.SetImageFormat(options.format); err != nil {
+		return err
+	}
+
+	// Effort maps to webp:method (0-6, 4 at the default effort) and heic:speed
+	// (9-0, used by the avif encoder), the other formats have no such setting
+	switch options.format {
+	case "webp":
+		if err := mw.SetOption("webp:method", strconv.Itoa(int(options.effort*6/9))); err != nil {
+			return err
+		}
+	case "avif":
+		if err := mw.SetOption("heic:speed", strconv.Itoa(int(9-options.effort))); err != nil {
+			return err
+		}
+	}
+
+	if options.lossless && options.format == "webp" {
+		if err := mw.SetOption("webp:lossless", "true"); err != nil {
+			return err
+		}
+	}
+
+	// Quality goes on after the format is picked so the output encoder gets it
+	return mw.SetImageCompressionQuality(options.outputQuality())
+}
+
+// Cut the crop window out of the current image, a missing or oversized crop
+// dimension keeps the full image size on that side
+func cropImage(mw *imagick.MagickWand, options optimizeOptions) error {
+
+	imageWidth := mw.GetImageWidth()
+	imageHeight := mw.GetImageHeight()
+
+	cropWidth, cropHeight := options.cropWidth, options.cropHeight
+
+	if cropWidth == 0 || cropWidth > imageWidth {
+		cropWidth = imageWidth
+	}
+
+	if cropHeight == 0 || cropHeight > imageHeight {
+		cropHeight = imageHeight
+	}
+
+	var x, y int
+
+	if options.gravity == "smart" {
+		x, y = smartCropOffset(mw, cropWidth, cropHeight)
+	} else {
+		position := cropGravities[options.gravity]
+		x = int(float64(imageWidth-cropWidth) * position.x)
+		y = int(float64(imageHeight-cropHeight) * position.y)
+	}
+
+	if err := mw.CropImage(cropWidth, cropHeight, x, y); err != nil {
+		return err
+	}
+
+	// Drop the virtual canvas left by the crop, gif and webp output would keep the offset
+	return mw.SetImagePage(cropWidth, cropHeight, 0, 0)
+}
+
+// Offset of the crop window with the most detail, measured as the standard
+// deviation of its pixels. A few positions are tried along each side with room
+// to move, ties keep the centered window.
+func smartCropOffset(mw *imagick.MagickWand, cropWidth, cropHeight uint) (int, int) {
+
+	const steps = 4
+
+	slackX := int(mw.GetImageWidth() - cropWidth)
+	slackY := int(mw.GetImageHeight() - cropHeight)
+
+	score := func(x, y int) float64 {
+		region := mw.GetImageRegion(cropWidth, cropHeight, x, y)
+
+		if region == nil {
+			return -1
+		}
+		defer region.Destroy()
+
+		_, deviation, err := region.GetImageChannelMean(imagick.CHANNELS_ALL)
+
+		if err != nil {
+			return -1
+		}
+
+		return deviation
+	}
+
+	bestX, bestY := slackX/2, slackY/2
+	bestScore := score(bestX, bestY)
+
+	for i := 0; i <= steps; i++ {
+		for j := 0; j <= steps; j++ {
+			x, y := slackX*i/steps, slackY*j/steps
+
+			if current := score(x, y); current > bestScore {
+				bestX, bestY, bestScore = x, y, current
+			}
+
+			// Without room on a side the other positions along it are the same window
+			if slackY == 0 {
+				break
+			}
+		}
+
+		if slackX == 0 {
+			break
+		}
+	}
+
+	return bestX, bestY
+}
@@ -0,0 +1,379 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"math/rand"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"gopkg.in/gographics/imagick.v2/imagick"
+)
+
+var imagickOnce sync.Once
+
+// Set up ImageMagick once for the tests that run the pipeline
+func setupImagick(t *testing.T) {
+
+	t.Helper()
+
+	imagickOnce.Do(func() {
+		imagick.Initialize()
+		configFormats()
+	})
+}
+
+// PNG fixture with a gradient, so the encoders have some detail to work with
+func fixturePNG(t *testing.T, width, height int) []byte {
+
+	t.Helper()
+
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+
+	for x := 0; x < width; x++ {
+		for y := 0; y < height; y++ {
+			img.Set(x, y, color.RGBA{R: uint8(x * 255 / width), G: uint8(y * 255 / height), B: 128, A: 255})
+		}
+	}
+
+	var buffer bytes.Buffer
+
+	if err := png.Encode(&buffer, img); err != nil {
+		t.Fatalf("encoding fixture: %v", err)
+	}
+
+	return buffer.Bytes()
+}
+
+// JPEG of random pixels at a low quality, re-encoding it losslessly makes it much bigger
+func noisyJPEG(t *testing.T) []byte {
+
+	t.Helper()
+
+	img := image.NewRGBA(image.Rect(0, 0, 64, 64))
+	random := rand.New(rand.NewSource(1))
+
+	for i := range img.Pix {
+		img.Pix[i] = uint8(random.Intn(256))
+	}
+
+	var buffer bytes.Buffer
+
+	if err := jpeg.Encode(&buffer, img, &jpeg.Options{Quality: 5}); err != nil {
+		t.Fatalf("encoding fixture: %v", err)
+	}
+
+	return buffer.Bytes()
+}
+
+func uintPointer(value uint) *uint {
+	return &value
+}
+
+func TestOptimizeBytes(t *testing.T) {
+
+	setupImagick(t)
+
+	tests := []struct {
+		name   string
+		opts   ImageOptions
+		width  uint
+		height uint
+		format string
+		magic  []byte
+	}{
+		{"defaults to webp", ImageOptions{}, 64, 48, "webp", []byte("RIFF")},
+		{"resize by width keeps aspect ratio", ImageOptions{Width: 32}, 32, 24, "webp", []byte("RIFF")},
+		{"resize by height keeps aspect ratio", ImageOptions{Height: 12}, 16, 12, "webp", []byte("RIFF")},
+		{"jpeg output", ImageOptions{Format: "jpeg", Quality: uintPointer(70)}, 64, 48, "jpeg", []byte{0xFF, 0xD8}},
+		{"original format", ImageOptions{Format: "original"}, 64, 48, "png", []byte("\x89PNG")},
+		{"sharpen after resize", ImageOptions{Width: 32, Sharpen: 0.8}, 32, 24, "webp", []byte("RIFF")},
+		{"no upscaling by default", ImageOptions{Width: 128}, 64, 48, "webp", []byte("RIFF")},
+		{"allow_upscale", ImageOptions{Width: 128, AllowUpscale: true}, 128, 96, "webp", []byte("RIFF")},
+		{"center crop", ImageOptions{CropWidth: 40, CropHeight: 40}, 40, 40, "webp", []byte("RIFF")},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			out, info, err := OptimizeBytes(fixturePNG(t, 64, 48), test.opts)
+
+			if err != nil {
+				t.Fatalf("OptimizeBytes returned error: %v", err)
+			}
+
+			if info.Width != test.width || info.Height != test.height {
+				t.Errorf("size = %dx%d, want %dx%d", info.Width, info.Height, test.width, test.height)
+			}
+
+			if info.InputFormat != "PNG" || info.Format != test.format {
+				t.Errorf("formats = %s -> %s, want PNG -> %s", info.InputFormat, info.Format, test.format)
+			}
+
+			if !bytes.HasPrefix(out, test.magic) {
+				t.Errorf("output starts with %q, want %q", out[:4], test.magic)
+			}
+		})
+	}
+}
+
+func TestOptimizeBytesInvalidInput(t *testing.T) {
+
+	setupImagick(t)
+
+	if _, _, err := OptimizeBytes([]byte("not an image"), ImageOptions{}); err == nil {
+		t.Error("OptimizeBytes accepted bytes that aren't an image")
+	}
+}
+
+func TestOptimizeImagesUnreadableSource(t *testing.T) {
+
+	setupImagick(t)
+
+	// The wand is created and fails on reading, the error must come from that read
+	store := newFakeStore()
+	store.objects["images/articles/cover.jpg"] = []byte("not an image")
+
+	recorder, response := postOptimize(t, store, `{"S3_URL": "s3://images/articles/cover.jpg"}`)
+
+	if recorder.Code != http.StatusUnsupportedMediaType {
+		t.Fatalf("status = %d, want %d: %s", recorder.Code, http.StatusUnsupportedMediaType, recorder.Body.String())
+	}
+
+	if response["stage"] != "process" {
+		t.Errorf("stage = %v, want process", response["stage"])
+	}
+
+	if message, _ := response["error"].(string); !strings.Contains(message, ErrNotAnImage.Error()) {
+		t.Errorf("error = %q, want it to mention %q", message, ErrNotAnImage)
+	}
+
+	// The failed read must still release the wand and the processing slot
+	if len(jobSlots) != 0 {
+		t.Errorf("%d processing slots still held", len(jobSlots))
+	}
+
+	if len(store.uploads) > 0 || len(store.deletes) > 0 {
+		t.Errorf("store was modified: uploads %v, deletes %v", store.uploads, store.deletes)
+	}
+}
+
+func TestOptimizeBytesInvalidOptions(t *testing.T) {
+
+	// Options are checked before ImageMagick is involved
+	tests := []struct {
+		name string
+		opts ImageOptions
+	}{
+		{"unsupported format", ImageOptions{Format: "bmp"}},
+		{"unsupported chroma subsampling", ImageOptions{ChromaSubsampling: "4:1:1"}},
+		{"unsupported gravity", ImageOptions{CropWidth: 10, Gravity: "middle"}},
+		{"gravity without crop", ImageOptions{Gravity: "north"}},
+		{"invalid background", ImageOptions{Background: "#12345g"}},
+		{"unsupported colorspace", ImageOptions{Colorspace: "lab"}},
+		{"cmyk without jpeg output", ImageOptions{Colorspace: "cmyk"}},
+		{"colorspace with preserve_colorspace", ImageOptions{Colorspace: "gray", PreserveColorspace: true}},
+		{"unknown quality preset", ImageOptions{QualityPreset: "best"}},
+		{"icc profile path", ImageOptions{ICCProfile: "../etc/passwd"}},
+		{"colorspace with icc profile", ImageOptions{Colorspace: "srgb", ICCProfile: "display"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			if _, _, err := OptimizeBytes(fixturePNG(t, 8, 8), test.opts); err == nil {
+				t.Errorf("OptimizeBytes accepted %+v", test.opts)
+			}
+		})
+	}
+}
+
+// Minimal ICC v2 RGB display profile: sRGB primaries adapted to D50 and a 2.2 gamma
+func displayICCProfile() []byte {
+
+	fixed := func(value float64) uint32 {
+		return uint32(int32(value * 65536))
+	}
+
+	xyz := func(x, y, z float64) []byte {
+		tag := make([]byte, 20)
+		copy(tag, "XYZ ")
+		binary.BigEndian.PutUint32(tag[8:], fixed(x))
+		binary.BigEndian.PutUint32(tag[12:], fixed(y))
+		binary.BigEndian.PutUint32(tag[16:], fixed(z))
+		return tag
+	}
+
+	description := make([]byte, 12, 12+17+11+67)
+	copy(description, "desc")
+	binary.BigEndian.PutUint32(description[8:], 17)
+	description = append(description, "Display profile\x00\x00"[:17]...)
+	description = append(description, make([]byte, 11+67)...)
+
+	copyright := append([]byte("text\x00\x00\x00\x00"), "No copyright\x00\x00\x00\x00"...)
+
+	gamma := []byte("curv\x00\x00\x00\x00\x00\x00\x00\x01\x02\x33\x00\x00")
+
+	tags := []struct {
+		signature string
+		data      []byte
+	}{
+		{"desc", description},
+		{"cprt", copyright},
+		{"wtpt", xyz(0.9642, 1, 0.8249)},
+		{"rXYZ", xyz(0.4361, 0.2225, 0.0139)},
+		{"gXYZ", xyz(0.3851, 0.7169, 0.0971)},
+		{"bXYZ", xyz(0.1431, 0.0606, 0.7141)},
+		{"rTRC", gamma},
+		{"gTRC", gamma},
+		{"bTRC", gamma},
+	}
+
+	header := make([]byte, 128)
+	binary.BigEndian.PutUint32(header[8:], 0x02100000)
+	copy(header[12:], "mntrRGB XYZ ")
+	copy(header[36:], "acsp")
+	copy(header[68:], xyz(0.9642, 1, 0.8249)[8:])
+
+	table := make([]byte, 4+12*len(tags))
+	binary.BigEndian.PutUint32(table, uint32(len(tags)))
+
+	var data []byte
+	offset := len(header) + len(table)
+
+	for i, tag := range tags {
+		entry := table[4+12*i:]
+		copy(entry, tag.signature)
+		binary.BigEndian.PutUint32(entry[4:], uint32(offset+len(data)))
+		binary.BigEndian.PutUint32(entry[8:], uint32(len(tag.data)))
+
+		// Tag data starts on 4 byte boundaries
+		data = append(data, tag.data...)
+		for len(data)%4 != 0 {
+			data = append(data, 0)
+		}
+	}
+
+	profile := append(append(header, table...), data...)
+	binary.BigEndian.PutUint32(profile, uint32(len(profile)))
+
+	return profile
+}
+
+func TestOptimizeBytesICCProfile(t *testing.T) {
+
+	setupImagick(t)
+
+	profile := displayICCProfile()
+	dir := t.TempDir()
+
+	if err := os.WriteFile(filepath.Join(dir, "display.icc"), profile, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv("ICC_PROFILE_DIR", dir)
+
+	// Metadata is stripped by default, the requested profile must still tag the output
+	out, _, err := OptimizeBytes(fixturePNG(t, 16, 16), ImageOptions{Format: "jpeg", ICCProfile: "display"})
+	if err != nil {
+		t.Fatalf("OptimizeBytes returned error: %v", err)
+	}
+
+	mw := imagick.NewMagickWand()
+	defer mw.Destroy()
+
+	if err := mw.ReadImageBlob(out); err != nil {
+		t.Fatalf("reading output: %v", err)
+	}
+
+	if embedded := mw.GetImageProfile("icc"); embedded != string(profile) {
+		t.Errorf("output has a %d byte ICC profile, want the %d byte requested one", len(embedded), len(profile))
+	}
+}
+
+func TestOptimizeImagesStoresResult(t *testing.T) {
+
+	setupImagick(t)
+
+	t.Setenv("AWS_BUCKET_NAME", "images")
+
+	tests := []struct {
+		name       string
+		source     []byte
+		body       string
+		status     int
+		operations []string
+	}{
+		{
+			"uploads before deleting the source",
+			nil,
+			`{"S3_URL": "s3://images/articles/cover.png", "skip_if_larger": false}`,
+			http.StatusCreated,
+			[]string{"upload images/articles/cover.webp", "delete images/articles/cover.png"},
+		},
+		{
+			"keep_original skips the delete",
+			nil,
+			`{"S3_URL": "s3://images/articles/cover.png", "keep_original": true, "skip_if_larger": false}`,
+			http.StatusCreated,
+			[]string{"upload images/articles/cover.webp"},
+		},
+		{
+			"skip_if_larger leaves the source untouched",
+			noisyJPEG(t),
+			`{"S3_URL": "s3://images/articles/cover.png", "format": "png"}`,
+			http.StatusOK,
+			nil,
+		},
+		{
+			"in_place overwrites the same key",
+			nil,
+			`{"S3_URL": "s3://images/articles/cover.png", "in_place": true, "skip_if_larger": false}`,
+			http.StatusOK,
+			[]string{"upload images/articles/cover.png"},
+		},
+	}
+
+	// skip_if_larger is turned off where the test needs a stored object whatever the sizes
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			source := test.source
+			if source == nil {
+				source = fixturePNG(t, 64, 48)
+			}
+
+			store := newFakeStore()
+			store.objects["images/articles/cover.png"] = source
+
+			recorder, response := postOptimize(t, store, test.body)
+
+			if recorder.Code != test.status {
+				t.Fatalf("status = %d, want %d: %v", recorder.Code, test.status, response)
+			}
+
+			if strings.Join(store.operations, ", ") != strings.Join(test.operations, ", ") {
+				t.Errorf("operations = %v, want %v", store.operations, test.operations)
+			}
+
+			// A stored object is announced with its URL, nothing new leaves no Location
+			location := recorder.Header().Get("Location")
+
+			if test.status == http.StatusCreated && (location == "" || location != response["url"]) {
+				t.Errorf("Location = %q, want the url %v", location, response["url"])
+			}
+
+			if test.status != http.StatusCreated && location != "" {
+				t.Errorf("Location = %q, want none", location)
+			}
+		})
+	}
+}
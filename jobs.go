@@ -0,0 +1,325 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Lifecycle of an async job
+const (
+	jobQueued     = "queued"
+	jobProcessing = "processing"
+	jobSucceeded  = "succeeded"
+	jobFailed     = "failed"
+)
+
+// Optimization running in the background, polled on /jobs/:id
+type asyncJob struct {
+	id       string
+	owner    string
+	status   string
+	code     int
+	err      string
+	stage    string
+	result   gin.H
+	results  []gin.H
+	created  time.Time
+	finished time.Time
+	expires  time.Time
+}
+
+// Status response of a job, the result fields match the synchronous endpoint
+func (job asyncJob) response() gin.H {
+
+	response := gin.H{
+		"job_id":     job.id,
+		"status":     job.status,
+		"created_at": job.created,
+	}
+
+	if !job.finished.IsZero() {
+		response["finished_at"] = job.finished
+		response["code"] = job.code
+	}
+
+	if job.err != "" {
+		response["error"] = job.err
+	}
+
+	if job.stage != "" {
+		response["stage"] = job.stage
+	}
+
+	if job.result != nil {
+		response["result"] = job.result
+	}
+
+	if job.results != nil {
+		response["results"] = job.results
+	}
+
+	return response
+}
+
+// In-memory jobs by ID, finished jobs are kept until their TTL runs out
+type jobStore struct {
+	mutex sync.Mutex
+	jobs  map[string]*asyncJob
+
+	// Jobs queued or processing
+	pending int
+}
+
+var asyncJobs = &jobStore{jobs: map[string]*asyncJob{}}
+
+// Background goroutines of async jobs, waited on at shutdown
+var runningJobs sync.WaitGroup
+
+// Returned when MAX_PENDING_JOBS async jobs are already queued or processing
+var ErrJobQueueFull = errors.New("too many async jobs are pending, try again later")
+
+// Async jobs accepted but not finished at once, 100 by default
+func getMaxPendingJobs() int {
+	return int(handleIntEnvVariable("MAX_PENDING_JOBS", 100))
+}
+
+// Create a queued job, false when limit jobs are already pending
+func (store *jobStore) create(owner string, limit int) (asyncJob, bool) {
+
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	if store.pending >= limit {
+		return asyncJob{}, false
+	}
+
+	job := &asyncJob{id: newRequestID(), owner: owner, status: jobQueued, created: time.Now()}
+	store.jobs[job.id] = job
+	store.pending++
+
+	return *job, true
+}
+
+// Copy of a job, only found by the token that created it
+func (store *jobStore) get(id string, owner string) (asyncJob, bool) {
+
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	job, found := store.jobs[id]
+
+	if !found || job.owner != owner {
+		return asyncJob{}, false
+	}
+
+	return *job, true
+}
+
+func (store *jobStore) start(id string) {
+
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	if job, found := store.jobs[id]; found {
+		job.status = jobProcessing
+	}
+}
+
+// Record the outcome, the job is kept for the TTL from now
+func (store *jobStore) finish(id string, code int, err error, result gin.H, results []gin.H, ttl time.Duration) asyncJob {
+
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	job, found := store.jobs[id]
+
+	if !found {
+		return asyncJob{}
+	}
+
+	store.pending--
+
+	job.status = jobSucceeded
+	job.code = code
+	job.result = result
+	job.results = results
+	job.finished = time.Now()
+	job.expires = job.finished.Add(ttl)
+
+	if err != nil {
+		job.status = jobFailed
+		job.err = err.Error()
+
+		var failedStage *stageError
+
+		if errors.As(err, &failedStage) {
+			job.stage = failedStage.stage
+		}
+	}
+
+	return *job
+}
+
+// Drop finished jobs past their TTL, running jobs are never dropped
+func (store *jobStore) removeExpired() {
+
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	now := time.Now()
+
+	for id, job := range store.jobs {
+		if !job.expires.IsZero() && now.After(job.expires) {
+			delete(store.jobs, id)
+		}
+	}
+}
+
+// How long finished jobs can be polled, 1 hour by default
+func getJobTTL() time.Duration {
+	return time.Duration(handleIntEnvVariable("JOB_TTL_SECONDS", 60*60)) * time.Second
+}
+
+// Wait for running async jobs until ctx is done, false when some are still running.
+// Called at shutdown, before ImageMagick is terminated under them.
+func waitForJobs(ctx context.Context) bool {
+
+	done := make(chan struct{})
+
+	go func() {
+		runningJobs.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// Start dropping expired jobs in the background
+func configJobs() {
+
+	go func() {
+		for range time.Tick(time.Minute) {
+			asyncJobs.removeExpired()
+		}
+	}()
+}
+
+// Body of an async request, an optimize request plus an optional callback
+type AsyncRequest struct {
+	OptimizeRequest
+
+	// Receives the finished job as a signed POST, see sendCallback
+	CallbackURL string `json:"callback_url"`
+}
+
+// Queue a job for the client and run it in the background, then respond 202 with
+// the job ID to poll on /jobs/:id. The gin context is reused once the handler
+// returns, so run only gets the IDs it needs.
+func startJob(c *gin.Context, run func(ctx context.Context, id string, requestID string)) {
+
+	job, created := asyncJobs.create(requestToken(c), getMaxPendingJobs())
+
+	if !created {
+		respondWithError(c, http.StatusTooManyRequests, ErrJobQueueFull.Error())
+		return
+	}
+
+	requestID := c.GetString("request_id")
+
+	runningJobs.Add(1)
+
+	go func() {
+		defer runningJobs.Done()
+
+		asyncJobs.start(job.id)
+
+		// The HTTP request is long gone, only the per-image timeout applies
+		run(context.Background(), job.id, requestID)
+	}()
+
+	c.Header("Location", "/jobs/"+job.id)
+	c.JSON(http.StatusAccepted, job.response())
+}
+
+// Run an optimize request, the job holds the outcome
+func runJob(ctx context.Context, store objectStore, id string, requestID string, request AsyncRequest, options optimizeOptions) {
+
+	var job asyncJob
+
+	if request.URLs != nil {
+		job = asyncJobs.finish(id, http.StatusOK, nil, nil, optimizeBatch(ctx, store, requestID, request.URLs, options), getJobTTL())
+	} else if result, code, err := optimizeAndLog(ctx, store, requestID, request.S3URL, options); err != nil {
+		job = asyncJobs.finish(id, code, err, nil, nil, getJobTTL())
+	} else {
+		job = asyncJobs.finish(id, code, nil, result.addTo(gin.H{}), nil, getJobTTL())
+	}
+
+	if request.CallbackURL != "" {
+		sendCallback(request.CallbackURL, requestID, job)
+	}
+}
+
+// Accept an optimize request and process it in the background, the body is the
+// same as /optimize/. Responds 202 with the job ID to poll on /jobs/:id.
+func OptimizeAsync(store objectStore) gin.HandlerFunc {
+
+	return func(c *gin.Context) {
+
+		var request AsyncRequest
+
+		if err := c.ShouldBindJSON(&request); err != nil {
+			respondWithError(c, bindErrorStatus(err), err.Error())
+			return
+		}
+
+		options, err := requestOptions(c, &request.OptimizeRequest)
+		if err != nil {
+			respondWithError(c, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		if options.returnInline {
+			respondWithError(c, http.StatusBadRequest, "return_inline can't be used with async jobs")
+			return
+		}
+
+		if request.CallbackURL != "" {
+			if !validCallbackURL(request.CallbackURL) {
+				respondWithError(c, http.StatusBadRequest, "callback_url must be a public https URL")
+				return
+			}
+
+			if getCallbackSecret() == "" {
+				respondWithError(c, http.StatusBadRequest, "callback_url requires CALLBACK_SECRET to be configured")
+				return
+			}
+		}
+
+		startJob(c, func(ctx context.Context, id string, requestID string) {
+			runJob(ctx, store, id, requestID, request, options)
+		})
+	}
+}
+
+// Status of an async job, and its result once finished
+func JobStatus(c *gin.Context) {
+
+	job, found := asyncJobs.get(c.Param("id"), requestToken(c))
+
+	if !found {
+		respondWithError(c, http.StatusNotFound, "Job not found")
+		return
+	}
+
+	c.JSON(http.StatusOK, job.response())
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"runtime"
+	"time"
+)
+
+// Bounds how many images are processed at once, ImageMagick is CPU and memory heavy
+var jobSlots chan struct{}
+
+// Returned when no processing slot frees up within the queue timeout
+var ErrTooManyJobs = errors.New("too many images are being processed, try again later")
+
+// Size the processing pool from MAX_CONCURRENT_JOBS, one job per CPU by default
+func configJobSlots() {
+	jobSlots = make(chan struct{}, handleIntEnvVariable("MAX_CONCURRENT_JOBS", int64(runtime.NumCPU())))
+}
+
+// Time a request waits in the queue for a processing slot
+func getJobQueueTimeout() time.Duration {
+	return time.Duration(handleIntEnvVariable("JOB_QUEUE_TIMEOUT_SECONDS", 10)) * time.Second
+}
+
+// Wait for a free processing slot, returns the status code and error when none is available
+func acquireJobSlot(ctx context.Context) (int, error) {
+
+	timer := time.NewTimer(getJobQueueTimeout())
+	defer timer.Stop()
+
+	select {
+	case jobSlots <- struct{}{}:
+		return http.StatusOK, nil
+	case <-timer.C:
+		return http.StatusTooManyRequests, ErrTooManyJobs
+	case <-ctx.Done():
+		return http.StatusGatewayTimeout, ctx.Err()
+	}
+}
+
+func releaseJobSlot() {
+	<-jobSlots
+}
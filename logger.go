@@ -0,0 +1,171 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"runtime/debug"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Header carrying the request ID back to the client
+const requestIDHeader = "X-Request-ID"
+
+// Fields attached to a structured log entry
+type logFields map[string]interface{}
+
+var jsonLogger = log.New(os.Stdout, "", 0)
+
+// Log levels by increasing severity, fatal entries are always written
+var logLevels = map[string]int{
+	"debug": 0,
+	"info":  1,
+	"error": 2,
+	"fatal": 3,
+}
+
+// Entries below this level are dropped, set once from LOG_LEVEL at startup
+var minLogLevel = logLevels["info"]
+
+// Read LOG_LEVEL (debug, info or error), info by default
+func configLogLevel() {
+
+	level, known := logLevels[strings.ToLower(handleEnvVariables("LOG_LEVEL"))]
+
+	if !known || level > logLevels["error"] {
+		level = logLevels["info"]
+	}
+
+	minLogLevel = level
+}
+
+// Write a single JSON log line, fields never override time, level and message
+func logEntry(level string, message string, fields logFields) {
+
+	if logLevels[level] < minLogLevel {
+		return
+	}
+
+	entry := logFields{
+		"time":    time.Now().UTC().Format(time.RFC3339Nano),
+		"level":   level,
+		"message": message,
+	}
+
+	for key, value := range fields {
+		if _, reserved := entry[key]; !reserved {
+			entry[key] = value
+		}
+	}
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		line, _ = json.Marshal(logFields{"time": entry["time"], "level": level, "message": message, "log_error": err.Error()})
+	}
+
+	jsonLogger.Println(string(line))
+}
+
+func logDebug(message string, fields logFields) {
+	logEntry("debug", message, fields)
+}
+
+func logInfo(message string, fields logFields) {
+	logEntry("info", message, fields)
+}
+
+func logError(message string, fields logFields) {
+	logEntry("error", message, fields)
+}
+
+func logFatal(message string, fields logFields) {
+	logEntry("fatal", message, fields)
+	os.Exit(1)
+}
+
+// Random hex ID identifying a single request
+func newRequestID() string {
+
+	id := make([]byte, 16)
+
+	if _, err := rand.Read(id); err != nil {
+		return hex.EncodeToString([]byte(time.Now().UTC().Format(time.RFC3339Nano)))
+	}
+
+	return hex.EncodeToString(id)
+}
+
+// Tag every request with an ID, returned in the response headers and used in the logs
+func RequestIDMiddleware() gin.HandlerFunc {
+
+	return func(c *gin.Context) {
+
+		requestID := newRequestID()
+
+		c.Set("request_id", requestID)
+		c.Header(requestIDHeader, requestID)
+
+		c.Next()
+	}
+}
+
+// Log every request once it is done, server errors at error level and the rest at info
+func RequestLoggerMiddleware() gin.HandlerFunc {
+
+	return func(c *gin.Context) {
+
+		start := time.Now()
+
+		c.Next()
+
+		fields := logFields{
+			"request_id":  c.GetString("request_id"),
+			"method":      c.Request.Method,
+			"path":        c.Request.URL.Path,
+			"status":      c.Writer.Status(),
+			"duration_ms": time.Since(start).Milliseconds(),
+			"client_ip":   c.ClientIP(),
+		}
+
+		// Health checks and scrapes arrive every few seconds, they are only logged at debug
+		switch {
+		case c.Writer.Status() >= http.StatusInternalServerError:
+			logError("Request failed", fields)
+		case c.Request.URL.Path == "/healthz" || c.Request.URL.Path == "/metrics":
+			logDebug("Request handled", fields)
+		default:
+			logInfo("Request handled", fields)
+		}
+	}
+}
+
+// Turn a panic in a handler into a 500, logged with its stack instead of taking down
+// the process. Replaces gin.Recovery, which writes plain text to stderr.
+func RecoveryMiddleware() gin.HandlerFunc {
+
+	return func(c *gin.Context) {
+
+		defer func() {
+			if recovered := recover(); recovered != nil {
+				logError("Panic while handling request", logFields{
+					"request_id": c.GetString("request_id"),
+					"method":     c.Request.Method,
+					"path":       c.Request.URL.Path,
+					"panic":      fmt.Sprint(recovered),
+					"stack":      string(debug.Stack()),
+				})
+
+				c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+			}
+		}()
+
+		c.Next()
+	}
+}
@@ -3,61 +3,468 @@ package main
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
 	"errors"
-	"log"
+	"fmt"
+	"io"
+	"math"
 	"net/http"
 	"net/url"
 	"os"
+	"os/signal"
+	"path"
 	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
+	"time"
 
+	awsv2 "github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/retry"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/credentials"
 	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/gin-contrib/gzip"
 	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/spf13/viper"
 	"gopkg.in/gographics/imagick.v2/imagick"
 )
 
 var awsS3Client *s3.Client
 
-func handleEnvVariables(key string) string {
+// AWS config built by configS3, other AWS clients share its credentials
+var awsConfig awsv2.Config
+
+// S3 bucket naming rules: 3-63 lowercase letters, digits, dots and hyphens
+var bucketNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9.-]{1,61}[a-z0-9]$`)
+
+// Extensions of source images, replaced by the output extension in the optimized key
+var imageExtensions = map[string]bool{
+	".jpg":  true,
+	".jpeg": true,
+	".png":  true,
+	".gif":  true,
+	".webp": true,
+	".avif": true,
+	".tif":  true,
+	".tiff": true,
+	".heic": true,
+	".heif": true,
+	".bmp":  true,
+}
+
+// Chroma subsampling accepted in the request, mapped to ImageMagick sampling factors
+var chromaSubsamplings = map[string][]float64{
+	"4:2:0": {4, 2, 0},
+	"4:2:2": {4, 2, 2},
+	"4:4:4": {4, 4, 4},
+}
+
+// Starting values a quality_preset sets, the granular fields of the request still win
+type qualityPreset struct {
+	quality            uint
+	chromaSubsampling  string
+	stripMetadata      bool
+	preserveColorspace bool
+}
+
+// Named presets for callers who don't want to pick ImageMagick settings themselves
+var qualityPresets = map[string]qualityPreset{
+	// Small files for pages, color detail is halved and metadata dropped
+	"web": {quality: 75, chromaSubsampling: "4:2:0", stripMetadata: true},
+	// Full color detail for hero images and photography
+	"high": {quality: 90, chromaSubsampling: "4:4:4", stripMetadata: true},
+	// Close to the source, keeping its metadata, ICC profile and colorspace
+	"archive": {quality: 95, chromaSubsampling: "4:4:4", preserveColorspace: true},
+}
+
+// Extension, Content-Type and transparency support of an optimized object
+type outputFormat struct {
+	extension   string
+	contentType string
+	alpha       bool
+}
+
+// Output formats accepted in the request
+var supportedFormats = map[string]outputFormat{
+	"webp": {extension: ".webp", contentType: "image/webp", alpha: true},
+	"avif": {extension: ".avif", contentType: "image/avif", alpha: true},
+	"jpeg": {extension: ".jpg", contentType: "image/jpeg"},
+	"png":  {extension: ".png", contentType: "image/png", alpha: true},
+}
+
+// Hex (#fff, #ffffff, #ffffffff) or named colors, names are checked by ImageMagick
+var colorPattern = regexp.MustCompile(`^(#[0-9a-fA-F]{3,8}|[a-zA-Z]+)$`)
+
+// Where the crop window sits in the image, as a fraction of the space left over
+type cropPosition struct {
+	x float64
+	y float64
+}
+
+// Gravities accepted for cropping, "smart" is handled separately
+var cropGravities = map[string]cropPosition{
+	"northwest": {0, 0},
+	"north":     {0.5, 0},
+	"northeast": {1, 0},
+	"west":      {0, 0.5},
+	"center":    {0.5, 0.5},
+	"east":      {1, 0.5},
+	"southwest": {0, 1},
+	"south":     {0.5, 1},
+	"southeast": {1, 1},
+}
+
+// Output format kept for each decoded input format when the request asks for the
+// original one, anything else is re-encoded as jpeg
+var originalFormats = map[string]string{
+	"JPEG": "jpeg",
+	"PNG":  "png",
+	"GIF":  "png",
+	"WEBP": "webp",
+	"AVIF": "avif",
+}
+
+// Settings bound to the environment in production
+var envVariables = []string{
+	"AWS_ACCESS_KEY_ID",
+	"AWS_SECRET_ACCESS_KEY",
+	"AWS_BUCKET_NAME",
+	"API_TOKEN",
+	"API_TOKENS",
+	"API_TOKEN_SECRET_ARN",
+	"AWS_REGION",
+	"SHUTDOWN_TIMEOUT_SECONDS",
+	"MAX_DOWNLOAD_BYTES",
+	"MAX_PIXEL_AREA",
+	"REQUEST_TIMEOUT_SECONDS",
+	"MAX_CONCURRENT_JOBS",
+	"JOB_QUEUE_TIMEOUT_SECONDS",
+	"S3_MAX_ATTEMPTS",
+	"S3_MAX_BACKOFF_MS",
+	"AWS_ENDPOINT_URL",
+	"S3_PUBLIC_URL",
+	"IDEMPOTENCY_TTL_SECONDS",
+	"IDEMPOTENCY_MAX_ENTRIES",
+	"IDEMPOTENCY_MAX_BYTES",
+	"LISTEN_ADDR",
+	"RATE_LIMIT_PER_SECOND",
+	"RATE_LIMIT_BURST",
+	"CORS_ALLOWED_ORIGINS",
+	"CORS_ALLOWED_METHODS",
+	"CORS_ALLOWED_HEADERS",
+	"DEFAULT_WEBP_QUALITY",
+	"DEFAULT_AVIF_QUALITY",
+	"DEFAULT_JPEG_QUALITY",
+	"DEFAULT_PNG_QUALITY",
+	"JOB_TTL_SECONDS",
+	"MAX_PENDING_JOBS",
+	"CALLBACK_SECRET",
+	"CALLBACK_ALLOW_HTTP",
+	"S3_SSE",
+	"S3_SSE_KMS_KEY_ID",
+	"S3_CACHE_CONTROL",
+	"MAX_BODY_BYTES",
+	"GZIP_LEVEL",
+	"DEFAULT_COLORSPACE",
+	"ICC_PROFILE_DIR",
+	"MAX_PREFIX_OBJECTS",
+	"MAX_BATCH_URLS",
+	"PREFIX_CONCURRENCY",
+	"LOG_LEVEL",
+	"ENABLE_PPROF",
+	"CONTENT_ADDRESSED_PREFIX",
+	"IMAGEMAGICK_MEMORY_LIMIT_MB",
+	"IMAGEMAGICK_MAP_LIMIT_MB",
+	"IMAGEMAGICK_DISK_LIMIT_MB",
+	"IMAGEMAGICK_AREA_LIMIT",
+	"IMAGEMAGICK_WIDTH_LIMIT",
+	"IMAGEMAGICK_HEIGHT_LIMIT",
+	"CDN_BASE_URL",
+	"REQUEST_SIGNING_SECRET",
+	"REQUEST_SIGNATURE_WINDOW_SECONDS",
+}
+
+// Viper is set up once, afterwards handleEnvVariables only reads from it, so
+// concurrent handlers and background jobs never write to viper's maps
+var configOnce sync.Once
+
+// Bind the env vars, plus CONFIG_FILE when set, in production. Other modes read .env.
+func configEnvVariables() {
 
 	if os.Getenv("mode") == "production" {
 
-		viper.BindEnv("AWS_ACCESS_KEY_ID")
-		viper.BindEnv("AWS_SECRET_ACCESS_KEY")
-		viper.BindEnv("AWS_BUCKET_NAME")
-		viper.BindEnv("API_TOKEN")
+		for _, key := range envVariables {
+			viper.BindEnv(key)
+		}
 
-	} else {
-		viper.SetConfigFile(".env")
-		// Find and read the config file
-		err := viper.ReadInConfig()
+		// A mounted file (e.g. a Kubernetes secret) can hold the config too, bound
+		// env vars still win over its values
+		if configFile := os.Getenv("CONFIG_FILE"); configFile != "" {
+			viper.SetConfigFile(configFile)
 
-		if err != nil {
-			log.Fatalf("Error while reading config file %s", err)
+			if err := viper.ReadInConfig(); err != nil {
+				logFatal("Error while reading config file", logFields{"config_file": configFile, "error": err.Error()})
+			}
 		}
+
+		return
+	}
+
+	viper.SetConfigFile(".env")
+	// Find and read the config file
+	err := viper.ReadInConfig()
+
+	if err != nil {
+		logFatal("Error while reading config file", logFields{"error": err.Error()})
 	}
+}
+
+func handleEnvVariables(key string) string {
+
+	configOnce.Do(configEnvVariables)
+
+	return viper.GetString(key)
+}
+
+// Region used for the S3 client and the returned object URLs
+func getAWSRegion() string {
+
+	region := handleEnvVariables("AWS_REGION")
 
-	value := viper.GetString(key)
+	if region == "" {
+		region = "ap-south-1"
+	}
+
+	return region
+}
+
+// Read a positive integer setting, falling back when it is unset or invalid
+func handleIntEnvVariable(key string, fallback int64) int64 {
+
+	value, err := strconv.ParseInt(handleEnvVariables(key), 10, 64)
+
+	if err != nil || value < 1 {
+		return fallback
+	}
 
 	return value
 }
 
-func configS3() {
+// Time given to in-flight requests to finish on shutdown
+func getShutdownTimeout() time.Duration {
+	return time.Duration(handleIntEnvVariable("SHUTDOWN_TIMEOUT_SECONDS", 30)) * time.Second
+}
+
+// Deadline for the S3 calls and processing of a single image, capped at 5 minutes
+func getRequestTimeout() time.Duration {
+
+	seconds := handleIntEnvVariable("REQUEST_TIMEOUT_SECONDS", 60)
+
+	if seconds > 300 {
+		seconds = 300
+	}
+
+	return time.Duration(seconds) * time.Second
+}
+
+// Largest source object downloaded, 25MB by default
+func getMaxDownloadBytes() int64 {
+	return handleIntEnvVariable("MAX_DOWNLOAD_BYTES", 25*1024*1024)
+}
+
+// Largest decoded image accepted in pixels (width * height), 50 megapixels by default
+func getMaxPixelArea() int64 {
+	return handleIntEnvVariable("MAX_PIXEL_AREA", 50000000)
+}
+
+// Check the required settings before serving traffic, listing every problem found
+func validateConfig() []string {
+
+	var problems []string
+
+	bucket := handleEnvVariables("AWS_BUCKET_NAME")
+
+	if bucket == "" {
+		problems = append(problems, "AWS_BUCKET_NAME is not set")
+	} else if !bucketNamePattern.MatchString(bucket) {
+		problems = append(problems, "AWS_BUCKET_NAME is not a valid S3 bucket name")
+	}
+
+	// A token from Secrets Manager is only fetched once S3 credentials are set up
+	if len(getAPITokens()) == 0 && handleEnvVariables("API_TOKEN_SECRET_ARN") == "" {
+		problems = append(problems, "Neither API_TOKEN, API_TOKENS nor API_TOKEN_SECRET_ARN is set")
+	}
+
+	// Static credentials come as a pair, otherwise the default chain (IAM role) is used
+	accessKey := handleEnvVariables("AWS_ACCESS_KEY_ID")
+	secretKey := handleEnvVariables("AWS_SECRET_ACCESS_KEY")
+
+	if accessKey != "" && secretKey == "" {
+		problems = append(problems, "AWS_SECRET_ACCESS_KEY is not set but AWS_ACCESS_KEY_ID is")
+	}
+
+	if accessKey == "" && secretKey != "" {
+		problems = append(problems, "AWS_ACCESS_KEY_ID is not set but AWS_SECRET_ACCESS_KEY is")
+	}
+
+	encryption := handleEnvVariables("S3_SSE")
+
+	if encryption != "" && encryption != string(types.ServerSideEncryptionAes256) && encryption != string(types.ServerSideEncryptionAwsKms) {
+		problems = append(problems, "S3_SSE must be AES256 or aws:kms")
+	}
+
+	if handleEnvVariables("S3_SSE_KMS_KEY_ID") != "" && encryption != string(types.ServerSideEncryptionAwsKms) {
+		problems = append(problems, "S3_SSE_KMS_KEY_ID requires S3_SSE=aws:kms")
+	}
+
+	return problems
+}
+
+// Colorspace images are converted to when the request sets none, srgb by default
+func getDefaultColorspace() string {
+
+	colorspace := strings.ToLower(handleEnvVariables("DEFAULT_COLORSPACE"))
+
+	if _, supported := colorspaces[colorspace]; !supported {
+		return "srgb"
+	}
+
+	return colorspace
+}
+
+// ICC profile by name from ICC_PROFILE_DIR, "FOGRA39" reads FOGRA39.icc
+func readICCProfile(name string) ([]byte, error) {
 
-	creds := credentials.NewStaticCredentialsProvider(handleEnvVariables("AWS_ACCESS_KEY_ID"), handleEnvVariables("AWS_SECRET_ACCESS_KEY"), "")
+	dir := handleEnvVariables("ICC_PROFILE_DIR")
+
+	if dir == "" {
+		return nil, errors.New("icc_profile requires ICC_PROFILE_DIR to be configured")
+	}
+
+	if strings.ContainsAny(name, `/\`) || strings.HasPrefix(name, ".") {
+		return nil, errors.New("icc_profile must be a profile name, not a path")
+	}
 
-	cfg, err := config.LoadDefaultConfig(context.TODO(), config.WithCredentialsProvider(creds), config.WithRegion("ap-south-1"))
+	profile, err := os.ReadFile(filepath.Join(dir, name+".icc"))
 	if err != nil {
-		log.Printf("error: %v", err)
-		return
+		return nil, fmt.Errorf("icc_profile %q not found", name)
+	}
+
+	return profile, nil
+}
+
+// Quality used when the request doesn't set one, DEFAULT_<FORMAT>_QUALITY or 80
+func getDefaultQuality(format string) uint {
+
+	quality := handleIntEnvVariable("DEFAULT_"+strings.ToUpper(format)+"_QUALITY", 80)
+
+	if quality > 100 {
+		quality = 100
+	}
+
+	return uint(quality)
+}
+
+func configS3() error {
+
+	// Throttling, 5xx and network errors are retried with exponential backoff and
+	// jitter, the SDK fails fast on non-retryable errors like NoSuchKey and stops
+	// once the request context is done
+	retryer := func() awsv2.Retryer {
+		return retry.NewStandard(func(o *retry.StandardOptions) {
+			o.MaxAttempts = int(handleIntEnvVariable("S3_MAX_ATTEMPTS", int64(retry.DefaultMaxAttempts)))
+			o.MaxBackoff = time.Duration(handleIntEnvVariable("S3_MAX_BACKOFF_MS", retry.DefaultMaxBackoff.Milliseconds())) * time.Millisecond
+		})
+	}
+
+	options := []func(*config.LoadOptions) error{config.WithRegion(getAWSRegion()), config.WithRetryer(retryer)}
+
+	// Static keys for local development, otherwise the default chain picks up
+	// instance, task or pod roles
+	if accessKeyID := handleEnvVariables("AWS_ACCESS_KEY_ID"); accessKeyID != "" {
+		creds := credentials.NewStaticCredentialsProvider(accessKeyID, handleEnvVariables("AWS_SECRET_ACCESS_KEY"), "")
+		options = append(options, config.WithCredentialsProvider(creds))
+	} else if profile := handleEnvVariables("AWS_PROFILE"); profile != "" && os.Getenv("mode") != "production" {
+		// Named profile from ~/.aws, so local runs use the same credentials as the CLI
+		options = append(options, config.WithSharedConfigProfile(profile))
+	}
+
+	cfg, err := config.LoadDefaultConfig(context.TODO(), options...)
+	if err != nil {
+		return err
+	}
+
+	awsConfig = cfg
+
+	// S3-compatible services (MinIO, DigitalOcean Spaces) are reached through
+	// their own endpoint with path-style addressing
+	endpoint := handleEnvVariables("AWS_ENDPOINT_URL")
+
+	awsS3Client = s3.NewFromConfig(cfg, func(o *s3.Options) {
+		if endpoint != "" {
+			o.EndpointResolver = s3.EndpointResolverFromURL(endpoint)
+			o.UsePathStyle = true
+		}
+	})
+
+	return nil
+}
+
+// Path-style hosts, the bucket is the first path segment:
+// s3.amazonaws.com, s3.<region>.amazonaws.com, s3-<region>.amazonaws.com,
+// s3.dualstack.<region>.amazonaws.com and their amazonaws.com.cn variants
+var s3PathStyleHost = regexp.MustCompile(`^s3(\.dualstack)?([.-][a-z0-9-]+)?\.amazonaws\.com(\.cn)?$`)
+
+// Virtual-hosted hosts, the bucket prefixes one of the path-style hosts. The bucket
+// match is greedy and the suffix anchored, so dotted buckets like "my.s3.assets"
+// are kept whole.
+var s3VirtualHostedHost = regexp.MustCompile(`^(.+)\.s3(\.dualstack)?([.-][a-z0-9-]+)?\.amazonaws\.com(\.cn)?$`)
+
+// Path of a URL below S3_PUBLIC_URL or AWS_ENDPOINT_URL, the hosts outside AWS that
+// are still S3
+func configuredEndpointPath(u *url.URL) (string, bool) {
+
+	for _, key := range []string{"S3_PUBLIC_URL", "AWS_ENDPOINT_URL"} {
+		if objectPath, found := pathBelow(handleEnvVariables(key), u); found {
+			return objectPath, true
+		}
+	}
+
+	return "", false
+}
+
+// Path of a URL relative to a base URL on the same host, false when it isn't below it
+func pathBelow(baseUrl string, u *url.URL) (string, bool) {
+
+	base, err := url.Parse(baseUrl)
+
+	if err != nil || base.Host == "" || !strings.EqualFold(base.Host, u.Host) {
+		return "", false
+	}
+
+	basePath := strings.Trim(base.Path, "/")
+	objectPath := strings.TrimLeft(u.Path, "/")
+
+	if basePath == "" {
+		return objectPath, true
+	}
+
+	if strings.HasPrefix(objectPath, basePath+"/") {
+		return strings.TrimPrefix(objectPath, basePath+"/"), true
 	}
 
-	awsS3Client = s3.NewFromConfig(cfg)
+	return "", false
 }
 
 //S3URLtoURI - return map contains bucket name and key
@@ -73,31 +480,105 @@ func S3URLtoURI(s3Url string) (map[string]string, error) {
 		m["bucket"] = u.Host
 		m["key"] = strings.TrimLeft(u.Path, "/")
 	} else if u.Scheme == "https" {
-		host := strings.SplitN(u.Host, ".", 2)
-		if host[0] == "s3" {
-			// No bucket name in the host;
-			path := strings.SplitN(u.Path, "/", 3)
-			m["bucket"] = path[1]
-			m["key"] = path[2]
-		} else { //bucket name in host
-			m["bucket"] = host[0]
+		host := strings.ToLower(u.Hostname())
+
+		if s3PathStyleHost.MatchString(host) {
+			// No bucket name in the host
+			segments := strings.SplitN(strings.TrimLeft(u.Path, "/"), "/", 2)
+			m["bucket"] = segments[0]
+			if len(segments) == 2 {
+				m["key"] = segments[1]
+			}
+		} else if match := s3VirtualHostedHost.FindStringSubmatch(host); match != nil {
+			m["bucket"] = match[1]
 			m["key"] = strings.TrimLeft(u.Path, "/")
+		} else if key, found := pathBelow(handleEnvVariables("CDN_BASE_URL"), u); found {
+			// URLs returned through the CDN only carry the key, the CDN serves AWS_BUCKET_NAME
+			m["bucket"] = handleEnvVariables("AWS_BUCKET_NAME")
+			m["key"] = key
+		} else if objectPath, found := configuredEndpointPath(u); found {
+			// Path-style under the custom endpoint or public URL, like objectURL returns
+			segments := strings.SplitN(objectPath, "/", 2)
+			m["bucket"] = segments[0]
+			if len(segments) == 2 {
+				m["key"] = segments[1]
+			}
+		} else {
+			return m, fmt.Errorf("%q is not an S3 host, use an s3:// URL or an S3 https URL", u.Host)
 		}
+	} else {
+		return m, fmt.Errorf("unsupported S3 URL scheme %q, use s3:// or https://", u.Scheme)
+	}
 
+	if m["bucket"] == "" || m["key"] == "" {
+		return m, errors.New("S3 URL must include a bucket and a key")
 	}
+
 	return m, err
 }
 
-func DownloadS3File(objectKey string, bucket string, s3Client *s3.Client) ([]byte, error) {
+// Returned when a source image is over the configured byte or pixel limits
+var ErrImageTooLarge = errors.New("image exceeds the maximum allowed size")
+
+// Returned when the source object (or its bucket) doesn't exist
+var ErrSourceNotFound = errors.New("source image not found")
+
+// NoSuchKey, NotFound (HeadObject has no error body) and NoSuchBucket all answer 404
+func isS3NotFound(err error) bool {
+
+	var responseError *awshttp.ResponseError
+
+	return errors.As(err, &responseError) && responseError.HTTPStatusCode() == http.StatusNotFound
+}
+
+// WriterAt refusing writes past a byte limit, so an oversized download aborts early
+type limitedWriterAt struct {
+	writer io.WriterAt
+	limit  int64
+}
+
+func (w *limitedWriterAt) WriteAt(p []byte, off int64) (int, error) {
+
+	if off+int64(len(p)) > w.limit {
+		return 0, ErrImageTooLarge
+	}
+
+	return w.writer.WriteAt(p, off)
+}
+
+func DownloadS3File(ctx context.Context, objectKey string, bucket string, s3Client *s3.Client, maxBytes int64) ([]byte, error) {
+
+	// Check the size before downloading anything
+	head, err := s3Client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(objectKey),
+	})
+	if isS3NotFound(err) {
+		return nil, ErrSourceNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if head.ContentLength > maxBytes {
+		return nil, ErrImageTooLarge
+	}
 
-	buffer := manager.NewWriteAtBuffer([]byte{})
+	// Sized up front so the buffer isn't grown (and copied) while the parts arrive
+	buffer := manager.NewWriteAtBuffer(make([]byte, 0, head.ContentLength))
 
 	downloader := manager.NewDownloader(s3Client)
 
-	numBytes, err := downloader.Download(context.TODO(), buffer, &s3.GetObjectInput{
+	numBytes, err := downloader.Download(ctx, &limitedWriterAt{writer: buffer, limit: maxBytes}, &s3.GetObjectInput{
 		Bucket: aws.String(bucket),
 		Key:    aws.String(objectKey),
 	})
+	if errors.Is(err, ErrImageTooLarge) {
+		return nil, ErrImageTooLarge
+	}
+	if isS3NotFound(err) {
+		return nil, ErrSourceNotFound
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -109,176 +590,1629 @@ func DownloadS3File(objectKey string, bucket string, s3Client *s3.Client) ([]byt
 	return buffer.Bytes(), nil
 }
 
-func UploadS3File(objectKey string, bucket string, s3Client *s3.Client, fileBytes []byte) error {
+// Key for an image fetched over HTTP(S), its URL path: https://cdn.example.com/a/b.jpg is a/b.jpg
+func HTTPURLtoKey(sourceUrl string) (map[string]string, error) {
 
-	_, err := s3Client.PutObject(context.TODO(), &s3.PutObjectInput{
-		Bucket: aws.String(bucket),
-		Key:    aws.String(objectKey),
-		Body:   bytes.NewReader(fileBytes),
-	})
+	m := make(map[string]string)
 
+	u, err := url.Parse(sourceUrl)
 	if err != nil {
-		return err
+		return m, err
 	}
 
-	return nil
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return m, fmt.Errorf("unsupported source URL scheme %q, use http:// or https://", u.Scheme)
+	}
+
+	m["key"] = strings.TrimLeft(u.Path, "/")
+
+	if u.Host == "" || m["key"] == "" {
+		return m, errors.New("source URL must include a host and a path")
+	}
+
+	return m, nil
 }
 
-func DeleteS3File(objectKey string, bucket string, s3Client *s3.Client) error {
+// Fetch an image over HTTP(S), bounded by maxBytes and the context deadline.
+// Internal addresses are refused, including through redirects.
+func DownloadHTTPFile(ctx context.Context, sourceUrl string, maxBytes int64) ([]byte, error) {
 
-	_, err := s3Client.DeleteObject(context.TODO(), &s3.DeleteObjectInput{
-		Bucket: aws.String(bucket),
-		Key:    aws.String(objectKey),
-	})
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, sourceUrl, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := checkPublicURL(request.URL); err != nil {
+		return nil, err
+	}
 
+	response, err := publicHTTPClient.Do(request)
 	if err != nil {
-		return err
+		return nil, err
 	}
+	defer response.Body.Close()
 
-	return nil
-}
+	if response.StatusCode == http.StatusNotFound {
+		return nil, ErrSourceNotFound
+	}
 
-func main() {
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching source image: unexpected status %s", response.Status)
+	}
 
-	port := ":" + os.Getenv("PORT")
+	if response.ContentLength > maxBytes {
+		return nil, ErrImageTooLarge
+	}
 
-	if port == ":" {
-		port = ":8080"
+	buffer := &bytes.Buffer{}
+
+	if response.ContentLength > 0 {
+		buffer.Grow(int(response.ContentLength) + 1)
 	}
 
-	if os.Getenv("mode") == "production" {
-		gin.SetMode(gin.ReleaseMode)
-	} else {
-		gin.SetMode(gin.DebugMode)
+	// Read one byte past the limit to tell a full body from a truncated one
+	if _, err := buffer.ReadFrom(io.LimitReader(response.Body, maxBytes+1)); err != nil {
+		return nil, err
 	}
 
-	router := gin.Default()
+	fileBytes := buffer.Bytes()
 
-	router.GET("/", Ping)
-	router.Use(APITokenMiddleware())
-	router.POST("/optimize/", OptimizeImages)
+	if int64(len(fileBytes)) > maxBytes {
+		return nil, ErrImageTooLarge
+	}
 
-	router.NoRoute(func(c *gin.Context) {
-		c.JSON(404, gin.H{"error": "Page not found"})
-	})
-	router.Run(port)
+	if len(fileBytes) < 1 {
+		return nil, errors.New("zero bytes written to memory")
+	}
 
+	return fileBytes, nil
 }
 
-// Respond to errors
-func respondWithError(c *gin.Context, code int, message interface{}) {
-	c.AbortWithStatusJSON(code, gin.H{"error": message})
+// Headers and user metadata stored with an uploaded object
+type objectMetadata struct {
+	cacheControl string
+	metadata     map[string]string
 }
 
-func APITokenMiddleware() gin.HandlerFunc {
+// Cache-Control of uploaded objects when the request sets none, e.g. "public, max-age=31536000, immutable"
+func getDefaultCacheControl() string {
+	return handleEnvVariables("S3_CACHE_CONTROL")
+}
 
-	requiredToken := handleEnvVariables("API_TOKEN")
+func UploadS3File(ctx context.Context, objectKey string, bucket string, s3Client *s3.Client, fileBytes []byte, contentType string, metadata objectMetadata) error {
 
-	// We want to make sure the token is set, bail if not
-	if requiredToken == "" {
-		log.Fatal("Please set API_TOKEN environment variable")
+	input := &s3.PutObjectInput{
+		Bucket:      aws.String(bucket),
+		Key:         aws.String(objectKey),
+		Body:        bytes.NewReader(fileBytes),
+		ContentType: aws.String(contentType),
+		Metadata:    metadata.metadata,
 	}
 
-	return func(c *gin.Context) {
+	if metadata.cacheControl != "" {
+		input.CacheControl = aws.String(metadata.cacheControl)
+	}
 
-		token := c.Request.Header.Get("token")
+	// Server-side encryption for buckets whose policy requires it
+	if encryption := handleEnvVariables("S3_SSE"); encryption != "" {
+		input.ServerSideEncryption = types.ServerSideEncryption(encryption)
 
-		if token == "" {
-			respondWithError(c, 401, "API token required")
-			return
+		if keyID := handleEnvVariables("S3_SSE_KMS_KEY_ID"); keyID != "" {
+			input.SSEKMSKeyId = aws.String(keyID)
 		}
+	}
 
-		if token != requiredToken {
-			respondWithError(c, 401, "Invalid API token")
-			return
-		}
+	// The upload manager sends large files in parallel parts read straight from
+	// the blob, small ones go in a single PutObject
+	_, err := manager.NewUploader(s3Client).Upload(ctx, input)
 
-		c.Next()
+	if err != nil {
+		return err
 	}
-}
 
-func Ping(c *gin.Context) {
-	c.JSON(200, gin.H{"message": "pong"})
+	return nil
 }
 
-func OptimizeImages(c *gin.Context) {
-	configS3()
+func DeleteS3File(ctx context.Context, objectKey string, bucket string, s3Client *s3.Client) error {
 
-	var imageData map[string]interface{}
+	_, err := s3Client.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(objectKey),
+	})
 
-	if err := c.BindJSON(&imageData); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
-		return
+	if err != nil {
+		return err
 	}
 
-	AWS_S3_URL := imageData["S3_URL"].(string)
-	s3map, err := S3URLtoURI(AWS_S3_URL)
+	return nil
+}
 
-	if err != nil {
-		respondWithError(c, http.StatusBadRequest, err.Error())
-		return
-	}
+// Keys under a prefix that pass keep, page by page. Stops at maxKeys and reports
+// whether more matching keys were left.
+func ListS3Prefix(ctx context.Context, bucket string, prefix string, s3Client *s3.Client, keep func(key string) bool, maxKeys int) ([]string, bool, error) {
 
-	fileBytes, err := DownloadS3File(s3map["key"], s3map["bucket"], awsS3Client)
-	if err != nil {
-		respondWithError(c, http.StatusBadRequest, err.Error())
-		return
-	}
+	var keys []string
 
-	imagick.Initialize()
-	defer imagick.Terminate()
+	paginator := s3.NewListObjectsV2Paginator(s3Client, &s3.ListObjectsV2Input{
+		Bucket: aws.String(bucket),
+		Prefix: aws.String(prefix),
+	})
 
-	mw := imagick.NewMagickWand()
-	if err != nil {
-		respondWithError(c, http.StatusBadRequest, err.Error())
-		return
-	}
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, false, err
+		}
 
-	if err := mw.ReadImageBlob(fileBytes); err != nil {
-		respondWithError(c, http.StatusBadRequest, err.Error())
-		return
-	}
+		for _, object := range page.Contents {
+			key := awsv2.ToString(object.Key)
 
-	mw.SetSamplingFactors([]float64{4, 2, 0})
-	mw.StripImage()
-	mw.SetImageCompressionQuality(80)
-	mw.SetImageColorspace(imagick.COLORSPACE_SRGB)
+			if !keep(key) {
+				continue
+			}
 
-	extension := filepath.Ext(s3map["key"])
+			if len(keys) == maxKeys {
+				return keys, true, nil
+			}
 
-	switch extension {
-	case ".jpg", ".jpeg":
-		mw.SetImageInterlaceScheme(imagick.INTERLACE_JPEG)
-	case ".png":
-		mw.SetImageInterlaceScheme(imagick.INTERLACE_PNG)
-	case ".gif":
-		mw.SetImageInterlaceScheme(imagick.INTERLACE_GIF)
+			keys = append(keys, key)
+		}
 	}
 
-	mw.SetImageFormat("webp")
+	return keys, false, nil
+}
 
-	name := s3map["key"][0 : len(s3map["key"])-len(extension)]
+// Public URL of an S3 object. Objects of AWS_BUCKET_NAME are served from CDN_BASE_URL
+// when set, otherwise URLs are path-style under S3_PUBLIC_URL or the custom endpoint.
+func objectURL(bucket string, objectKey string) string {
 
-	//Delete the original file
-	err = DeleteS3File(s3map["key"], s3map["bucket"], awsS3Client)
+	if cdnURL := handleEnvVariables("CDN_BASE_URL"); cdnURL != "" && bucket == handleEnvVariables("AWS_BUCKET_NAME") {
+		return strings.TrimRight(cdnURL, "/") + "/" + objectKey
+	}
 
-	if err != nil {
-		respondWithError(c, http.StatusBadRequest, err.Error())
+	baseURL := handleEnvVariables("S3_PUBLIC_URL")
+
+	if baseURL == "" {
+		baseURL = handleEnvVariables("AWS_ENDPOINT_URL")
+	}
+
+	if baseURL == "" {
+		baseURL = "https://s3." + getAWSRegion() + ".amazonaws.com"
+	}
+
+	return strings.TrimRight(baseURL, "/") + "/" + bucket + "/" + objectKey
+}
+
+// Time-limited GET URL for an object in a private bucket
+func PresignS3File(objectKey string, bucket string, s3Client *s3.Client, expiry time.Duration) (string, error) {
+
+	presignClient := s3.NewPresignClient(s3Client)
+
+	request, err := presignClient.PresignGetObject(context.TODO(), &s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(objectKey),
+	}, s3.WithPresignExpires(expiry))
+
+	if err != nil {
+		return "", err
+	}
+
+	return request.URL, nil
+}
+
+func HeadS3Bucket(ctx context.Context, bucket string, s3Client *s3.Client) error {
+
+	_, err := s3Client.HeadBucket(ctx, &s3.HeadBucketInput{
+		Bucket: aws.String(bucket),
+	})
+
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Address the server binds to, LISTEN_ADDR wins over the platform provided PORT
+func getListenAddr() string {
+
+	if addr := handleEnvVariables("LISTEN_ADDR"); addr != "" {
+		return addr
+	}
+
+	port := ":" + os.Getenv("PORT")
+
+	if port == ":" {
+		port = ":8080"
+	}
+
+	return port
+}
+
+func main() {
+
+	if os.Getenv("mode") == "production" {
+		gin.SetMode(gin.ReleaseMode)
+	} else {
+		gin.SetMode(gin.DebugMode)
+	}
+
+	configLogLevel()
+
+	if problems := validateConfig(); len(problems) > 0 {
+		logFatal("Invalid configuration", logFields{"problems": problems})
+	}
+
+	// Build the S3 client once, every request shares it
+	if err := configS3(); err != nil {
+		logFatal("Error while configuring S3 client", logFields{"error": err.Error()})
+	}
+
+	if err := configAPITokenSecret(); err != nil {
+		logFatal("Error while reading the API token secret", logFields{"error": err.Error()})
+	}
+
+	// ImageMagick is set up once for the whole process, handlers only create wands
+	imagick.Initialize()
+	defer imagick.Terminate()
+
+	configJobSlots()
+	configFormats()
+	configResourceLimits()
+	configJobs()
+
+	// gin.New rather than gin.Default, requests are logged once as JSON by RequestLoggerMiddleware
+	router := gin.New()
+
+	router.Use(RequestIDMiddleware())
+	router.Use(RequestLoggerMiddleware())
+	router.Use(RecoveryMiddleware())
+
+	if level := getGzipLevel(); level != 0 {
+		router.Use(GzipMiddleware(level))
+	}
+
+	router.GET("/", Ping)
+	router.GET("/healthz", HealthCheck)
+	router.GET("/version", Version)
+	router.GET("/metrics", gin.WrapH(promhttp.Handler()))
+	// Uploads carry the image itself, so they get room for a full size source
+	bodyLimits := map[string]int64{"/optimize/upload": getMaxDownloadBytes() + 1024*1024}
+	bodyLimit := BodyLimitMiddleware(getMaxBodyBytes())
+	uploadLimit := BodyLimitMiddleware(bodyLimits["/optimize/upload"])
+
+	router.Use(CORSMiddleware())
+	router.Use(APITokenMiddleware())
+	router.Use(RequestSignatureMiddleware(bodyLimits))
+	router.Use(RateLimitMiddleware())
+	idempotency := IdempotencyMiddleware()
+
+	// Handlers get the object store injected, tests swap in a fake
+	store := s3Store{client: awsS3Client}
+
+	router.POST("/optimize/", bodyLimit, idempotency, OptimizeImages(store))
+	router.POST("/optimize/upload", uploadLimit, idempotency, OptimizeUpload(store))
+	router.POST("/optimize/async", bodyLimit, idempotency, OptimizeAsync(store))
+	router.POST("/optimize/prefix", bodyLimit, idempotency, OptimizePrefix(store))
+	router.GET("/jobs/:id", JobStatus)
+	router.GET("/capabilities", Capabilities)
+
+	// Profiles include command line arguments and memory contents, so they stay behind the token
+	if pprofEnabled() {
+		router.GET("/debug/pprof/*profile", Pprof)
+
+		// go tool pprof resolves symbols with a POST to /debug/pprof/symbol
+		router.POST("/debug/pprof/*profile", Pprof)
+	}
+
+	router.NoRoute(func(c *gin.Context) {
+		c.JSON(404, gin.H{"error": "Page not found"})
+	})
+
+	// Known paths hit with the wrong method get a 405 listing the methods they accept
+	router.HandleMethodNotAllowed = true
+	router.NoMethod(MethodNotAllowed(router))
+
+	srv := &http.Server{
+		Addr:    getListenAddr(),
+		Handler: router,
+	}
+
+	go func() {
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			logFatal("Error while starting server", logFields{"error": err.Error()})
+		}
+	}()
+
+	// Wait for SIGINT/SIGTERM, then let in-flight optimizations finish
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
+	<-quit
+
+	logInfo("Shutting down server", nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), getShutdownTimeout())
+	defer cancel()
+
+	if err := srv.Shutdown(ctx); err != nil {
+		logFatal("Error while shutting down server", logFields{"error": err.Error()})
+	}
+
+	// Async jobs outlive their requests, they get the rest of the shutdown timeout.
+	// Jobs still inside ImageMagick must not see it terminated under them, so the
+	// process exits without running the deferred Terminate.
+	if !waitForJobs(ctx) {
+		logFatal("Async jobs still running at shutdown, exiting without terminating ImageMagick", nil)
+	}
+
+	logInfo("Server stopped", nil)
+}
+
+// 405 with an Allow header listing the methods registered for the request path,
+// parameterized routes like /jobs/:id included
+func MethodNotAllowed(router *gin.Engine) gin.HandlerFunc {
+
+	return func(c *gin.Context) {
+
+		var allowed []string
+
+		for _, route := range router.Routes() {
+			if routeMatches(route.Path, c.Request.URL.Path) {
+				allowed = append(allowed, route.Method)
+			}
+		}
+
+		sort.Strings(allowed)
+
+		c.Header("Allow", strings.Join(allowed, ", "))
+		c.JSON(http.StatusMethodNotAllowed, gin.H{"error": "Method not allowed"})
+	}
+}
+
+// Whether a path matches a gin route pattern, :name matches one segment and
+// *name the rest of the path
+func routeMatches(pattern string, requestPath string) bool {
+
+	patternSegments := strings.Split(pattern, "/")
+	pathSegments := strings.Split(requestPath, "/")
+
+	for i, segment := range patternSegments {
+		if i >= len(pathSegments) {
+			return false
+		}
+
+		switch {
+		case strings.HasPrefix(segment, "*"):
+			return true
+		case strings.HasPrefix(segment, ":"):
+			if pathSegments[i] == "" {
+				return false
+			}
+		case segment != pathSegments[i]:
+			return false
+		}
+	}
+
+	return len(patternSegments) == len(pathSegments)
+}
+
+// Respond to errors
+func respondWithError(c *gin.Context, code int, message interface{}) {
+	c.AbortWithStatusJSON(code, gin.H{"error": message})
+}
+
+// Compression level of responses from 1 (fastest) to 9 (smallest), 0 turns compression off
+func getGzipLevel() int {
+
+	level, err := strconv.Atoi(handleEnvVariables("GZIP_LEVEL"))
+
+	if err != nil || level < 0 || level > 9 {
+		return gzip.DefaultCompression
+	}
+
+	return level
+}
+
+// Compress responses for clients sending Accept-Encoding: gzip. The upload endpoint
+// mostly returns already compressed images, and /metrics is compressed by the
+// Prometheus handler itself, so both are left out.
+func GzipMiddleware(level int) gin.HandlerFunc {
+	return gzip.Gzip(level, gzip.WithExcludedPaths([]string{"/optimize/upload", "/metrics"}))
+}
+
+// Most images one urls batch can list, 100 by default
+func getMaxBatchURLs() int {
+	return int(handleIntEnvVariable("MAX_BATCH_URLS", 100))
+}
+
+// Largest JSON request body in bytes, 1MB by default
+func getMaxBodyBytes() int64 {
+	return handleIntEnvVariable("MAX_BODY_BYTES", 1024*1024)
+}
+
+// Refuse request bodies over the limit with a 413, chunked bodies without a
+// Content-Length fail when the handler reads past the limit
+func BodyLimitMiddleware(limit int64) gin.HandlerFunc {
+
+	return func(c *gin.Context) {
+
+		if c.Request.ContentLength > limit {
+			respondWithError(c, http.StatusRequestEntityTooLarge, "Request body too large")
+			return
+		}
+
+		c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, limit)
+
+		c.Next()
+	}
+}
+
+// Status for a body that failed to bind, 413 when it ran past the body limit
+func bindErrorStatus(err error) int {
+
+	if strings.Contains(err.Error(), "http: request body too large") {
+		return http.StatusRequestEntityTooLarge
+	}
+
+	return http.StatusBadRequest
+}
+
+// Valid API tokens, the Secrets Manager token replaces API_TOKEN when configured. API_TOKENS holds a comma-separated list so old tokens can be phased out
+func getAPITokens() []string {
+
+	var tokens []string
+
+	if secretAPIToken != "" {
+		tokens = append(tokens, secretAPIToken)
+	} else if token := handleEnvVariables("API_TOKEN"); token != "" {
+		tokens = append(tokens, token)
+	}
+
+	return append(tokens, splitList(handleEnvVariables("API_TOKENS"))...)
+}
+
+// Token presented by the client, either in the token header or as an Authorization bearer token
+func requestToken(c *gin.Context) string {
+
+	if token := c.Request.Header.Get("token"); token != "" {
+		return token
+	}
+
+	authorization := c.Request.Header.Get("Authorization")
+
+	if len(authorization) > len("Bearer ") && strings.EqualFold(authorization[:len("Bearer ")], "Bearer ") {
+		return strings.TrimSpace(authorization[len("Bearer "):])
+	}
+
+	return ""
+}
+
+func APITokenMiddleware() gin.HandlerFunc {
+
+	validTokens := getAPITokens()
+
+	// We want to make sure a token is set, bail if not
+	if len(validTokens) == 0 {
+		logFatal("Please set API_TOKEN or API_TOKENS environment variable", nil)
+	}
+
+	return func(c *gin.Context) {
+
+		token := requestToken(c)
+
+		if token == "" {
+			respondWithError(c, 401, "API token required")
+			return
+		}
+
+		// Constant time and no early exit, so neither the token nor which one matched
+		// can be guessed from response timings
+		matched := 0
+
+		for _, validToken := range validTokens {
+			matched |= subtle.ConstantTimeCompare([]byte(token), []byte(validToken))
+		}
+
+		if matched != 1 {
+			respondWithError(c, 401, "Invalid API token")
+			return
+		}
+
+		c.Next()
+	}
+}
+
+func Ping(c *gin.Context) {
+	c.JSON(200, gin.H{"message": "pong"})
+}
+
+// Readiness probe, healthy only when the optimized bucket is reachable
+func HealthCheck(c *gin.Context) {
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), getRequestTimeout())
+	defer cancel()
+
+	err := HeadS3Bucket(ctx, handleEnvVariables("AWS_BUCKET_NAME"), awsS3Client)
+
+	if err != nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"status": "unhealthy", "error": err.Error()})
 		return
 	}
 
+	c.JSON(http.StatusOK, gin.H{"status": "healthy"})
+}
+
+// Options shared by every image of an optimize request
+type optimizeOptions struct {
+	format           string
+	quality          uint
+	webpQuality      uint
+	width            uint
+	height           uint
+	stripMetadata    bool
+	samplingFactors  []float64
+	lossless         bool
+	cropWidth        uint
+	cropHeight       uint
+	gravity          string
+	background       string
+	density          uint
+	sharpen          float64
+	allowUpscale     bool
+	sizes            []uint
+	contentAddressed bool
+	inPlace          bool
+	effort           uint
+	colorspace       string
+	keepColorspace   bool
+	iccProfile       []byte
+	keepOriginal     bool
+	outputKey        string
+	outputSuffix     string
+	outputBucket     string
+	objectMetadata   objectMetadata
+	presign          time.Duration
+	returnInline     bool
+	httpSource       bool
+	dryRun           bool
+	skipIfLarger     bool
+	debug            bool
+}
+
+// Outcome of a single successful optimization
+type optimizeResult struct {
+	url            string
+	bucket         string
+	key            string
+	source         objectLocation
+	originalBytes  int
+	optimizedBytes int
+	width          uint
+	height         uint
+	inputFormat    string
+	format         string
+
+	// Set when the optimized image came out larger and the source was left as is
+	skipped bool
+
+	// Set when the upload overwrote the source object instead of creating one
+	replaced bool
+
+	// Milliseconds spent per phase, only reported when debugging
+	timings map[string]int64
+
+	// Optimized bytes, only kept when returned inline
+	blob []byte
+
+	// One entry per requested width, the fields above describe the first one
+	sizes []sizedImage
+}
+
+// Where an object lives, the bucket is empty for HTTP(S) sources
+type objectLocation struct {
+	url    string
+	bucket string
+	key    string
+}
+
+// Location of the source, normalized to s3://bucket/key for S3 objects
+func sourceObject(sourceUrl string, s3map map[string]string, options optimizeOptions) objectLocation {
+
+	if options.httpSource {
+		return objectLocation{url: sourceUrl, key: s3map["key"]}
+	}
+
+	return objectLocation{url: s3ObjectURL(s3map["bucket"], s3map["key"]), bucket: s3map["bucket"], key: s3map["key"]}
+}
+
+// Add the result fields to a JSON response. url and optimized_url are the same,
+// url is kept for existing clients.
+func (result optimizeResult) addTo(response gin.H) gin.H {
+
+	response["url"] = result.url
+	response["optimized_url"] = result.url
+	response["optimized_bucket"] = result.bucket
+	response["optimized_key"] = result.key
+
+	// Uploaded images have no source object
+	if result.source.url != "" {
+		response["source_url"] = result.source.url
+		response["source_bucket"] = result.source.bucket
+		response["source_key"] = result.source.key
+	}
+	response["original_bytes"] = result.originalBytes
+	response["optimized_bytes"] = result.optimizedBytes
+	response["width"] = result.width
+	response["height"] = result.height
+	response["input_format"] = result.inputFormat
+	response["format"] = result.format
+	response["skipped"] = result.skipped
+
+	if result.timings != nil {
+		response["timings"] = result.timings
+	}
+
+	if result.sizes != nil {
+		sizes := make([]gin.H, 0, len(result.sizes))
+
+		for _, sized := range result.sizes {
+			sizes = append(sizes, gin.H{"width": sized.width, "height": sized.height, "url": sized.url, "key": sized.key, "optimized_bytes": sized.optimizedBytes})
+		}
+
+		response["sizes"] = sizes
+	}
+
+	// Negative when the optimized image is larger than the original
+	if result.originalBytes > 0 {
+		savedPercent := float64(result.originalBytes-result.optimizedBytes) / float64(result.originalBytes) * 100
+		response["saved_percent"] = math.Round(savedPercent*10) / 10
+	}
+
+	return response
+}
+
+// Processing options shared by the JSON and upload endpoints
+type ImageOptions struct {
+	Format  string `json:"format" form:"format"`
+	Quality *uint  `json:"quality" form:"quality" binding:"omitempty,min=1,max=100"`
+	Width   uint   `json:"width" form:"width"`
+	Height  uint   `json:"height" form:"height"`
+
+	// Resizes past the source dimensions are clamped to them unless allow_upscale is set
+	AllowUpscale bool `json:"allow_upscale" form:"allow_upscale"`
+
+	// Crop window applied before resizing, placed by gravity (center by default)
+	CropWidth  uint   `json:"crop_width" form:"crop_width"`
+	CropHeight uint   `json:"crop_height" form:"crop_height"`
+	Gravity    string `json:"gravity" form:"gravity"`
+
+	// Color transparent areas are flattened onto when the output has no alpha (jpeg), white by default
+	Background string `json:"background" form:"background"`
+
+	// DPI written to the output metadata, the pixels aren't resampled
+	Density uint `json:"density" form:"density" binding:"omitempty,max=10000"`
+
+	// Sigma of an unsharp mask applied after resizing, around 0.5 to 1 for thumbnails, off by default
+	Sharpen float64 `json:"sharpen" form:"sharpen" binding:"omitempty,min=0,max=10"`
+
+	// Encoder effort from 0 (fastest) to 9 (smallest file) for webp and avif, 6 by default
+	Effort *uint `json:"effort" form:"effort" binding:"omitempty,max=9"`
+
+	// Target colorspace (srgb, gray or cmyk for jpeg), DEFAULT_COLORSPACE or srgb by default.
+	// icc_profile names a profile in ICC_PROFILE_DIR the pixels are converted to instead,
+	// the output is tagged with it.
+	Colorspace string `json:"colorspace" form:"colorspace"`
+	ICCProfile string `json:"icc_profile" form:"icc_profile"`
+
+	// Keep the decoded colorspace, e.g. for grayscale scans that shouldn't gain color channels
+	PreserveColorspace bool `json:"preserve_colorspace" form:"preserve_colorspace"`
+
+	// Overrides quality when the output is webp, other formats ignore it
+	WebPQuality *uint `json:"webp_quality" form:"webp_quality" binding:"omitempty,min=1,max=100"`
+
+	// Lossless webp for graphics like logos and screenshots, other formats ignore it
+	Lossless bool `json:"lossless" form:"lossless"`
+
+	// web, high or archive, sets the quality, chroma subsampling, metadata and colorspace
+	// handling in one go. Any of those fields sent alongside overrides the preset.
+	QualityPreset string `json:"quality_preset" form:"quality_preset"`
+
+	// Metadata (EXIF, ICC profiles) is stripped unless strip_metadata is false
+	StripMetadata     *bool  `json:"strip_metadata" form:"strip_metadata"`
+	ChromaSubsampling string `json:"chroma_subsampling" form:"chroma_subsampling"`
+}
+
+// Output format defaults to webp and quality to the format's default, a single resize dimension keeps the aspect ratio
+func (image ImageOptions) optimizeOptions() (optimizeOptions, error) {
+
+	options := optimizeOptions{
+		format:          "webp",
+		width:           image.Width,
+		height:          image.Height,
+		stripMetadata:   true,
+		samplingFactors: chromaSubsamplings["4:2:0"],
+		lossless:        image.Lossless,
+		cropWidth:       image.CropWidth,
+		cropHeight:      image.CropHeight,
+		gravity:         "center",
+		background:      "white",
+		density:         image.Density,
+		sharpen:         image.Sharpen,
+		allowUpscale:    image.AllowUpscale,
+		effort:          6,
+		colorspace:      getDefaultColorspace(),
+		keepColorspace:  image.PreserveColorspace,
+	}
+
+	if image.Effort != nil {
+		options.effort = *image.Effort
+	}
+
+	if image.QualityPreset != "" {
+		preset, found := qualityPresets[strings.ToLower(image.QualityPreset)]
+
+		if !found {
+			return options, errors.New("Unknown quality_preset, use one of web, high or archive")
+		}
+
+		options.quality = preset.quality
+		options.samplingFactors = chromaSubsamplings[preset.chromaSubsampling]
+		options.stripMetadata = preset.stripMetadata
+		options.keepColorspace = preset.preserveColorspace || image.PreserveColorspace
+	}
+
+	// "original" keeps the input format, resolved once the image is decoded
+	if strings.EqualFold(image.Format, "original") {
+		options.format = ""
+	} else if image.Format != "" {
+		options.format = strings.ToLower(image.Format)
+
+		if _, supported := supportedFormats[options.format]; !supported {
+			return options, errors.New("Unsupported format, use one of webp, avif, jpeg, png or original")
+		}
+	}
+
+	if image.Quality != nil {
+		options.quality = *image.Quality
+	}
+
+	if image.WebPQuality != nil {
+		options.webpQuality = *image.WebPQuality
+	}
+
+	if image.StripMetadata != nil {
+		options.stripMetadata = *image.StripMetadata
+	}
+
+	if image.ChromaSubsampling != "" {
+		samplingFactors, supported := chromaSubsamplings[image.ChromaSubsampling]
+
+		if !supported {
+			return options, errors.New("Unsupported chroma_subsampling, use one of 4:2:0, 4:2:2 or 4:4:4")
+		}
+
+		options.samplingFactors = samplingFactors
+	}
+
+	if image.Colorspace != "" && image.PreserveColorspace {
+		return options, errors.New("colorspace can't be used with preserve_colorspace")
+	}
+
+	if image.Colorspace != "" && image.ICCProfile != "" {
+		return options, errors.New("colorspace can't be used with icc_profile, the profile sets the colorspace")
+	}
+
+	if image.Colorspace != "" {
+		options.colorspace = strings.ToLower(image.Colorspace)
+		options.keepColorspace = false
+
+		if _, supported := colorspaces[options.colorspace]; !supported {
+			return options, errors.New("Unsupported colorspace, use one of srgb, gray or cmyk")
+		}
+	}
+
+	// A cmyk DEFAULT_COLORSPACE only applies to jpeg output, a request asking for it must be jpeg
+	if options.colorspace == "cmyk" && options.format != "jpeg" {
+		if image.Colorspace != "" {
+			return options, errors.New("cmyk colorspace requires jpeg output")
+		}
+
+		options.colorspace = "srgb"
+	}
+
+	if image.ICCProfile != "" {
+		profile, err := readICCProfile(image.ICCProfile)
+		if err != nil {
+			return options, err
+		}
+
+		options.iccProfile = profile
+	}
+
+	if image.Background != "" {
+		if !colorPattern.MatchString(image.Background) {
+			return options, errors.New("background must be a hex color like #ffffff or a color name")
+		}
+
+		options.background = image.Background
+	}
+
+	if image.Gravity != "" {
+		options.gravity = strings.ToLower(image.Gravity)
+
+		if _, supported := cropGravities[options.gravity]; !supported && options.gravity != "smart" {
+			return options, errors.New("Unsupported gravity, use a compass direction like north or southeast, center or smart")
+		}
+
+		if image.CropWidth == 0 && image.CropHeight == 0 {
+			return options, errors.New("gravity requires crop_width or crop_height")
+		}
+	}
+
+	return options, nil
+}
+
+// Body of an optimize request, one of S3_URL, urls or source_url must be set
+type OptimizeRequest struct {
+	ImageOptions
+
+	S3URL        string   `json:"S3_URL" binding:"required_without_all=URLs SourceURL"`
+	URLs         []string `json:"urls" binding:"omitempty,min=1"`
+	SourceURL    string   `json:"source_url"`
+	KeepOriginal bool     `json:"keep_original"`
+	OutputKey    string   `json:"output_key"`
+	OutputSuffix string   `json:"output_suffix"`
+	OutputBucket string   `json:"output_bucket"`
+
+	// Widths of a responsive set, each one uploaded with a "_<width>" suffixed key
+	Sizes []uint `json:"sizes" binding:"omitempty,max=10,dive,min=1"`
+
+	// Recompress in the source's own format and overwrite it at the same key, so stored
+	// URLs stay valid, answered with 200 as no new object is created. Only JPEG, PNG, WebP
+	// and AVIF sources can be written back.
+	InPlace bool `json:"in_place"`
+
+	// Name the output after the SHA-256 of its bytes under CONTENT_ADDRESSED_PREFIX,
+	// so identical output always lands on the same key and can be cached forever
+	ContentAddressed bool `json:"content_addressed"`
+
+	// Stored with the optimized object, Cache-Control defaults to S3_CACHE_CONTROL
+	CacheControl string            `json:"cache_control"`
+	Metadata     map[string]string `json:"metadata"`
+
+	// Presigned URLs default to one hour and can last up to 7 days
+	Presign              bool `json:"presign"`
+	PresignExpirySeconds uint `json:"presign_expiry_seconds" binding:"omitempty,max=604800"`
+
+	// Send the optimized bytes back instead of storing them, the source is left untouched
+	ReturnInline bool `json:"return_inline"`
+
+	// Run the pipeline and report the predicted output without uploading or deleting anything
+	DryRun bool `json:"dry_run"`
+
+	// Leave the source untouched when optimizing makes it bigger, true by default
+	SkipIfLarger *bool `json:"skip_if_larger"`
+
+	// Report how long each phase took, also enabled by an X-Debug: true header
+	Debug bool `json:"debug"`
+}
+
+// Pick the output format from an Accept header like a CDN would, AVIF then WebP
+// then the original format, skipping formats this ImageMagick build can't encode.
+// Empty when the header doesn't say.
+func negotiateFormat(accept string) string {
+
+	if accept == "" {
+		return ""
+	}
+
+	accepted := map[string]bool{}
+
+	for _, mediaRange := range strings.Split(accept, ",") {
+		parts := strings.Split(mediaRange, ";")
+		quality := 1.0
+
+		for _, param := range parts[1:] {
+			if value := strings.TrimSpace(param); strings.HasPrefix(value, "q=") {
+				quality, _ = strconv.ParseFloat(value[len("q="):], 64)
+			}
+		}
+
+		// Ranges given q=0 are explicitly refused
+		if quality > 0 {
+			accepted[strings.ToLower(strings.TrimSpace(parts[0]))] = true
+		}
+	}
+
+	switch {
+	case accepted["image/avif"] && availableFormats["avif"]:
+		return "avif"
+	case accepted["image/webp"] && availableFormats["webp"]:
+		return "webp"
+	case accepted["*/*"] || accepted["image/*"] || accepted["application/json"]:
+		return ""
+	}
+
+	return "original"
+}
+
+// Options of a JSON optimize request, the errors are client errors (400)
+func requestOptions(c *gin.Context, request *OptimizeRequest) (optimizeOptions, error) {
+
+	// In place output keeps the source format
+	if request.InPlace {
+		if request.Format != "" && !strings.EqualFold(request.Format, "original") {
+			return optimizeOptions{}, errors.New("in_place keeps the source format, format must be empty or original")
+		}
+
+		if request.OutputKey != "" || request.OutputSuffix != "" || request.OutputBucket != "" || request.ContentAddressed {
+			return optimizeOptions{}, errors.New("in_place can't be used with output_key, output_suffix, output_bucket or content_addressed")
+		}
+
+		if request.Sizes != nil || request.SourceURL != "" || request.ReturnInline {
+			return optimizeOptions{}, errors.New("in_place can't be used with sizes, source_url or return_inline")
+		}
+
+		request.Format = "original"
+	}
+
+	options, err := request.optimizeOptions()
+	if err != nil {
+		return options, err
+	}
+
+	options.keepOriginal = request.KeepOriginal
+	options.inPlace = request.InPlace
+	options.dryRun = request.DryRun
+	options.skipIfLarger = request.SkipIfLarger == nil || *request.SkipIfLarger
+	options.debug = request.Debug
+
+	if debug, err := strconv.ParseBool(c.Request.Header.Get("X-Debug")); err == nil && debug {
+		options.debug = true
+	}
+
+	// Batches run in one request, MAX_BATCH_URLS keeps them within its timeout
+	if maxURLs := getMaxBatchURLs(); len(request.URLs) > maxURLs {
+		return options, fmt.Errorf("urls can list at most %d images", maxURLs)
+	}
+
+	// Destination key used verbatim, by default the source key with the new extension
+	if request.OutputKey != "" {
+		if request.URLs != nil {
+			return options, errors.New("output_key can't be used with urls")
+		}
+
+		options.outputKey = strings.TrimLeft(request.OutputKey, "/")
+	}
+
+	// Appended to the generated key so both versions can live side by side
+	if request.OutputSuffix != "" {
+		if request.OutputKey != "" {
+			return options, errors.New("output_suffix can't be used with output_key")
+		}
+
+		if strings.Contains(request.OutputSuffix, "/") {
+			return options, errors.New("output_suffix can't contain /")
+		}
+
+		options.outputSuffix = request.OutputSuffix
+	}
+
+	// Destination bucket, by default AWS_BUCKET_NAME
+	if request.OutputBucket != "" {
+		if !bucketNamePattern.MatchString(request.OutputBucket) {
+			return options, errors.New("output_bucket is not a valid S3 bucket name")
+		}
+
+		options.outputBucket = request.OutputBucket
+	}
+
+	options.objectMetadata.cacheControl = getDefaultCacheControl()
+
+	if request.CacheControl != "" {
+		options.objectMetadata.cacheControl = request.CacheControl
+	}
+
+	// S3 allows 2KB of user metadata, counted over the keys and values
+	if request.Metadata != nil {
+		size := 0
+
+		for key, value := range request.Metadata {
+			if key == "" {
+				return options, errors.New("metadata keys can't be empty")
+			}
+
+			size += len(key) + len(value)
+		}
+
+		if size > 2048 {
+			return options, errors.New("metadata must be at most 2KB")
+		}
+
+		options.objectMetadata.metadata = request.Metadata
+	}
+
+	if request.ContentAddressed {
+		if request.OutputKey != "" || request.OutputSuffix != "" {
+			return options, errors.New("content_addressed can't be used with output_key or output_suffix")
+		}
+
+		options.contentAddressed = true
+	}
+
+	if request.Sizes != nil {
+		if request.Width > 0 || request.Height > 0 {
+			return options, errors.New("sizes can't be used with width or height")
+		}
+
+		if request.OutputKey != "" {
+			return options, errors.New("sizes can't be used with output_key")
+		}
+
+		seen := map[uint]bool{}
+
+		for _, width := range request.Sizes {
+			if seen[width] {
+				return options, errors.New("sizes must not repeat a width")
+			}
+
+			seen[width] = true
+		}
+
+		options.sizes = request.Sizes
+	}
+
+	// Return a presigned URL instead of the public one
+	if request.Presign {
+		options.presign = time.Hour
+
+		if request.PresignExpirySeconds > 0 {
+			options.presign = time.Duration(request.PresignExpirySeconds) * time.Second
+		}
+	}
+
+	if request.ReturnInline {
+		if request.URLs != nil || request.Sizes != nil {
+			return options, errors.New("return_inline can't be used with urls or sizes")
+		}
+
+		options.returnInline = true
+	}
+
+	// Images outside S3 are fetched over HTTP(S), the source is never deleted
+	if request.SourceURL != "" {
+		if request.URLs != nil || request.S3URL != "" {
+			return options, errors.New("source_url can't be used with S3_URL or urls")
+		}
+
+		options.httpSource = true
+		request.S3URL = request.SourceURL
+	}
+
+	return options, nil
+}
+
+func OptimizeImages(store objectStore) gin.HandlerFunc {
+
+	return func(c *gin.Context) {
+
+		var request OptimizeRequest
+
+		// Malformed requests are client errors (4xx), S3 and ImageMagick failures are server errors (5xx)
+		if err := c.ShouldBindJSON(&request); err != nil {
+			respondWithError(c, bindErrorStatus(err), err.Error())
+			return
+		}
+
+		// Without an explicit format the Accept header picks one, so caches must key on
+		// it (added to the Vary the CORS middleware may have set). Only this endpoint
+		// negotiates, async and prefix jobs aren't served back to the client.
+		if request.Format == "" && !request.InPlace {
+			c.Writer.Header().Add("Vary", "Accept")
+			request.Format = negotiateFormat(c.Request.Header.Get("Accept"))
+		}
+
+		options, err := requestOptions(c, &request)
+		if err != nil {
+			respondWithError(c, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		if request.URLs != nil {
+			c.JSON(http.StatusOK, gin.H{"results": optimizeBatch(c.Request.Context(), store, c.GetString("request_id"), request.URLs, options)})
+			return
+		}
+
+		result, code, err := optimizeAndLog(c.Request.Context(), store, c.GetString("request_id"), request.S3URL, options)
+
+		if err != nil {
+			c.AbortWithStatusJSON(code, errorFields(err, gin.H{}))
+			return
+		}
+
+		if options.returnInline {
+			c.Data(http.StatusOK, supportedFormats[result.format].contentType, result.blob)
+			return
+		}
+
+		if options.dryRun {
+			c.JSON(http.StatusOK, result.addTo(gin.H{"message": "Dry run, nothing was uploaded or deleted", "dry_run": true}))
+			return
+		}
+
+		if result.skipped {
+			c.JSON(http.StatusOK, result.addTo(gin.H{"message": "Optimized image was larger, the original was kept"}))
+			return
+		}
+
+		// The source was overwritten, nothing new was created at another URL
+		if result.replaced {
+			c.JSON(http.StatusOK, result.addTo(gin.H{"message": "Image optimized in place"}))
+			return
+		}
+
+		// A new object was stored, so 201 with its URL as the Location
+		c.Header("Location", result.url)
+		c.JSON(http.StatusCreated, result.addTo(gin.H{"message": "Image optimized successfully"}))
+	}
+}
+
+// Form fields of a direct upload, the image itself is sent as the "image" file
+type UploadRequest struct {
+	ImageOptions
+
+	OutputKey string `form:"output_key"`
+}
+
+// Optimize an image sent as multipart/form-data. The optimized bytes are returned
+// as is, unless ?destination=s3 asks to store them in AWS_BUCKET_NAME instead.
+func OptimizeUpload(store objectStore) gin.HandlerFunc {
+
+	return func(c *gin.Context) {
+
+		var request UploadRequest
+
+		if err := c.ShouldBind(&request); err != nil {
+			respondWithError(c, bindErrorStatus(err), err.Error())
+			return
+		}
+
+		options, err := request.optimizeOptions()
+		if err != nil {
+			respondWithError(c, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		fileHeader, err := c.FormFile("image")
+		if err != nil {
+			respondWithError(c, http.StatusBadRequest, "image file is required")
+			return
+		}
+
+		if fileHeader.Size > getMaxDownloadBytes() {
+			respondWithError(c, http.StatusRequestEntityTooLarge, ErrImageTooLarge.Error())
+			return
+		}
+
+		file, err := fileHeader.Open()
+		if err != nil {
+			respondWithError(c, http.StatusBadRequest, err.Error())
+			return
+		}
+		defer file.Close()
+
+		fileBytes, err := io.ReadAll(file)
+		if err != nil {
+			respondWithError(c, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		code, err := acquireJobSlot(c.Request.Context())
+		if err != nil {
+			respondWithError(c, code, err.Error())
+			return
+		}
+
+		processed, code, err := processImage(fileBytes, options)
+		releaseJobSlot()
+
+		if err != nil {
+			c.AbortWithStatusJSON(code, errorFields(&stageError{stage: "process", err: err}, gin.H{}))
+			return
+		}
+
+		contentType := supportedFormats[processed.format].contentType
+
+		if c.Query("destination") != "s3" {
+			c.Data(http.StatusOK, contentType, processed.blob)
+			return
+		}
+
+		// Stored under output_key, or the uploaded file name with the new extension
+		name := strings.TrimLeft(request.OutputKey, "/")
+
+		if name == "" {
+			base := filepath.Base(fileHeader.Filename)
+
+			if strings.Trim(base, "./") == "" {
+				base = c.GetString("request_id")
+			}
+
+			name = optimizedKey(base, "", processed.format)
+		}
+
+		optimizedBucket := handleEnvVariables("AWS_BUCKET_NAME")
+
+		ctx, cancel := context.WithTimeout(c.Request.Context(), getRequestTimeout())
+		defer cancel()
+
+		err = store.Upload(ctx, optimizedBucket, name, processed.blob, contentType, objectMetadata{cacheControl: getDefaultCacheControl()})
+		if err != nil {
+			c.AbortWithStatusJSON(s3ErrorStatus(err), errorFields(&stageError{stage: "upload", err: err}, gin.H{}))
+			return
+		}
+
+		result := optimizeResult{
+			url:            objectURL(optimizedBucket, name),
+			bucket:         optimizedBucket,
+			key:            name,
+			originalBytes:  len(fileBytes),
+			optimizedBytes: len(processed.blob),
+			width:          processed.width,
+			height:         processed.height,
+			inputFormat:    processed.inputFormat,
+			format:         processed.format,
+		}
+
+		// A new object was stored, so 201 with its URL as the Location
+		c.Header("Location", result.url)
+		c.JSON(http.StatusCreated, result.addTo(gin.H{"message": "Image optimized successfully"}))
+	}
+}
+
+// Batch form, every url reports its own outcome and failures don't abort the rest
+func optimizeBatch(ctx context.Context, store objectStore, requestID string, urls []string, options optimizeOptions) []gin.H {
+
+	results := make([]gin.H, 0, len(urls))
+
+	for _, s3Url := range urls {
+		result, code, err := optimizeAndLog(ctx, store, requestID, s3Url, options)
+
+		if err != nil {
+			results = append(results, errorFields(err, gin.H{"S3_URL": s3Url, "status": code}))
+			continue
+		}
+
+		results = append(results, result.addTo(gin.H{"S3_URL": s3Url, "status": code}))
+	}
+
+	return results
+}
+
+// Optimize a single S3 object and log the outcome with the request ID
+func optimizeAndLog(ctx context.Context, store objectStore, requestID string, s3Url string, options optimizeOptions) (optimizeResult, int, error) {
+
+	start := time.Now()
+
+	ctx, cancel := context.WithTimeout(ctx, getRequestTimeout())
+	defer cancel()
+
+	optimize := optimizeImage
+
+	if options.sizes != nil {
+		optimize = optimizeSizes
+	}
+
+	result, code, err := optimize(ctx, store, s3Url, options)
+
+	fields := logFields{
+		"request_id":  requestID,
+		"s3_url":      s3Url,
+		"status":      code,
+		"duration_ms": time.Since(start).Milliseconds(),
+		"outcome":     "success",
+	}
+
+	if s3map, err := S3URLtoURI(s3Url); err == nil {
+		fields["s3_key"] = s3map["key"]
+	}
+
+	if err != nil {
+		fields["outcome"] = "failure"
+		errorFields(err, gin.H(fields))
+		logError("Image optimization failed", fields)
+	} else {
+		logInfo("Image optimized", fields)
+	}
+
+	return result, code, err
+}
+
+// Key named after the SHA-256 of the optimized bytes, under CONTENT_ADDRESSED_PREFIX
+func contentAddressedKey(blob []byte, format string) string {
+
+	sum := sha256.Sum256(blob)
+	prefix := strings.Trim(handleEnvVariables("CONTENT_ADDRESSED_PREFIX"), "/")
+	name := hex.EncodeToString(sum[:]) + supportedFormats[format].extension
+
+	if prefix == "" {
+		return name
+	}
+
+	return prefix + "/" + name
+}
+
+// Key of the optimized object, the output extension is always appended explicitly.
+// Only a real image extension is replaced: "a.jpg", "a." and "a" become "a.webp",
+// "a.v2" becomes "a.v2.webp" and a bare ".jpg" name becomes ".jpg.webp".
+// The suffix goes before the extension, "a.jpg" with "_opt" becomes "a_opt.webp".
+func optimizedKey(sourceKey string, suffix string, format string) string {
+
+	base := strings.TrimRight(sourceKey, ".")
+	extension := path.Ext(base)
+	stem := strings.TrimSuffix(base, extension)
+
+	if imageExtensions[strings.ToLower(extension)] && stem != "" && !strings.HasSuffix(stem, "/") {
+		base = stem
+	}
+
+	return base + suffix + supportedFormats[format].extension
+}
+
+// What each stage of the pipeline was doing, prefixed to its errors
+var stageDescriptions = map[string]string{
+	"request":  "parsing the source url",
+	"download": "downloading the source image",
+	"process":  "processing the image",
+	"upload":   "uploading to s3",
+	"delete":   "deleting the original from s3",
+	"presign":  "presigning the url",
+}
+
+// Error of a pipeline stage, reported as the error and stage fields of the response
+type stageError struct {
+	stage string
+	err   error
+}
+
+func (e *stageError) Error() string {
+	return stageDescriptions[e.stage] + ": " + e.err.Error()
+}
+
+func (e *stageError) Unwrap() error {
+	return e.err
+}
+
+// Add the error, and the stage it happened in when known, to a JSON response
+func errorFields(err error, response gin.H) gin.H {
+
+	response["error"] = err.Error()
+
+	var failedStage *stageError
+
+	if errors.As(err, &failedStage) {
+		response["stage"] = failedStage.stage
+	}
+
+	return response
+}
+
+// Status code for a failed S3 call, 504 when it ran past the deadline
+func s3ErrorStatus(err error) int {
+
+	if errors.Is(err, context.DeadlineExceeded) {
+		return http.StatusGatewayTimeout
+	}
+
+	return http.StatusInternalServerError
+}
+
+// Bucket and key of the source, the key alone for HTTP(S) sources
+func sourceLocation(sourceUrl string, options optimizeOptions) (map[string]string, error) {
+
+	if options.httpSource {
+		return HTTPURLtoKey(sourceUrl)
+	}
+
+	return S3URLtoURI(sourceUrl)
+}
+
+// Download the source image, returns the status code and error to report on failure
+func downloadSource(ctx context.Context, store objectStore, sourceUrl string, s3map map[string]string, options optimizeOptions) ([]byte, int, error) {
+
+	var fileBytes []byte
+	var err error
+
+	if options.httpSource {
+		fileBytes, err = DownloadHTTPFile(ctx, sourceUrl, getMaxDownloadBytes())
+	} else {
+		fileBytes, err = store.Download(ctx, s3map["bucket"], s3map["key"], getMaxDownloadBytes())
+	}
+	if errors.Is(err, ErrImageTooLarge) {
+		return nil, http.StatusRequestEntityTooLarge, err
+	}
+	if errors.Is(err, ErrSourceNotFound) {
+		return nil, http.StatusNotFound, err
+	}
+	if errors.Is(err, ErrPrivateAddress) {
+		return nil, http.StatusBadRequest, err
+	}
+	if err != nil {
+		return nil, s3ErrorStatus(err), err
+	}
+
+	return fileBytes, http.StatusOK, nil
+}
+
+// Optimize a single S3 object, or HTTP(S) image when options.httpSource is set,
+// returns the result or the status code and error to report
+func optimizeImage(ctx context.Context, store objectStore, AWS_S3_URL string, options optimizeOptions) (result optimizeResult, code int, err error) {
+
+	// Failures are counted by the stage they happened in
+	stage := "request"
+	timings := map[string]int64{}
+
+	defer func() {
+		recordOptimization(stage, err)
+
+		if err != nil {
+			err = &stageError{stage: stage, err: err}
+		}
+
+		if err == nil && options.debug {
+			result.timings = timings
+		}
+	}()
+
+	s3map, err := sourceLocation(AWS_S3_URL, options)
+	if err != nil {
+		return optimizeResult{}, http.StatusBadRequest, err
+	}
+
+	stage = "download"
+	start := time.Now()
+
+	fileBytes, code, err := downloadSource(ctx, store, AWS_S3_URL, s3map, options)
+	if err != nil {
+		return optimizeResult{}, code, err
+	}
+
+	timings["download_ms"] = observePhase("download", start).Milliseconds()
+
+	stage = "process"
+	start = time.Now()
+
+	code, err = acquireJobSlot(ctx)
+	if err != nil {
+		return optimizeResult{}, code, err
+	}
+
+	processed, code, err := processImage(fileBytes, options)
+	releaseJobSlot()
+
+	if err != nil {
+		return optimizeResult{}, code, err
+	}
+
+	// The source bytes aren't needed past this point, let them be collected during the upload
+	originalBytes := len(fileBytes)
+	fileBytes = nil
+
+	blob := processed.blob
+
+	timings["process_ms"] = observePhase("process", start).Milliseconds()
+
+	// ImageMagick can't be interrupted, so check the deadline before going back to S3
+	if ctx.Err() != nil {
+		return optimizeResult{}, http.StatusGatewayTimeout, ctx.Err()
+	}
+
+	result = optimizeResult{
+		source:         sourceObject(AWS_S3_URL, s3map, options),
+		originalBytes:  originalBytes,
+		optimizedBytes: len(blob),
+		width:          processed.width,
+		height:         processed.height,
+		inputFormat:    processed.inputFormat,
+		format:         processed.format,
+	}
+
+	// GIF, TIFF and HEIC sources are written as another format, so they can't stay at their key
+	if options.inPlace && processed.format != strings.ToLower(processed.inputFormat) {
+		return optimizeResult{}, http.StatusUnprocessableEntity, fmt.Errorf("in_place can't write %s back, the output would be %s", strings.ToLower(processed.inputFormat), processed.format)
+	}
+
+	if options.returnInline {
+		observeSavedRatio(originalBytes, len(blob))
+
+		result.blob = blob
+
+		return result, http.StatusOK, nil
+	}
+
+	// Nothing is uploaded or deleted, the returned URL is the untouched source
+	if options.skipIfLarger && len(blob) > originalBytes {
+		result.skipped = true
+		result.url = AWS_S3_URL
+		result.bucket, result.key = result.source.bucket, result.source.key
+
+		return result, http.StatusOK, nil
+	}
+
+	name := optimizedKey(s3map["key"], options.outputSuffix, processed.format)
+
+	if options.outputKey != "" {
+		name = options.outputKey
+	}
+
+	if options.contentAddressed {
+		name = contentAddressedKey(blob, processed.format)
+	}
+
 	// Upload the optimized file
 	optimizedBucket := handleEnvVariables("AWS_BUCKET_NAME")
 
-	err = UploadS3File(name, optimizedBucket, awsS3Client, mw.GetImageBlob())
+	if options.outputBucket != "" {
+		optimizedBucket = options.outputBucket
+	}
+
+	// Recompressed in place, the upload overwrites the source so nothing is deleted
+	if options.inPlace {
+		name = s3map["key"]
+		optimizedBucket = s3map["bucket"]
+	}
+
+	result.bucket, result.key = optimizedBucket, name
+
+	// Dry runs stop before touching S3, reporting where the optimized file would go
+	if options.dryRun {
+		result.url = objectURL(optimizedBucket, name)
+
+		return result, http.StatusOK, nil
+	}
+
+	stage = "upload"
+	start = time.Now()
+
+	err = store.Upload(ctx, optimizedBucket, name, blob, supportedFormats[processed.format].contentType, options.objectMetadata)
 	if err != nil {
-		respondWithError(c, http.StatusBadRequest, err.Error())
-		return
+		return optimizeResult{}, s3ErrorStatus(err), err
 	}
-	// Destroy the MagickWand
-	mw.Destroy()
 
-	finalUrl := "https://s3.ap-south-1.amazonaws.com/" + optimizedBucket + "/" + name
+	timings["upload_ms"] = observePhase("upload", start).Milliseconds()
+
+	// Delete the original file only once the optimized one is stored, and never
+	// when the upload replaced it in place or the optimized file would be lost
+	replacedInPlace := optimizedBucket == s3map["bucket"] && name == s3map["key"]
+	result.replaced = replacedInPlace
+
+	if !options.keepOriginal && !replacedInPlace && !options.httpSource {
+		stage = "delete"
+		start = time.Now()
+
+		err = store.Delete(ctx, s3map["bucket"], s3map["key"])
+
+		if err != nil {
+			return optimizeResult{}, s3ErrorStatus(err), err
+		}
+
+		timings["delete_ms"] = observePhase("delete", start).Milliseconds()
+	}
+
+	finalUrl := objectURL(optimizedBucket, name)
+
+	if options.presign > 0 {
+		stage = "presign"
+
+		finalUrl, err = store.Presign(optimizedBucket, name, options.presign)
+		if err != nil {
+			return optimizeResult{}, http.StatusInternalServerError, err
+		}
+	}
+
+	observeSavedRatio(originalBytes, len(blob))
+
+	result.url = finalUrl
 
-	c.JSON(http.StatusOK, gin.H{"message": "Image optimized successfully", "url": finalUrl})
+	return result, http.StatusOK, nil
 }
@@ -0,0 +1,1041 @@
+package main
+
+import (
+	stdgzip "compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-contrib/gzip"
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/common/expfmt"
+)
+
+func TestMain(m *testing.M) {
+
+	// Read settings from the environment instead of a .env file
+	os.Setenv("mode", "production")
+	gin.SetMode(gin.TestMode)
+
+	// Set up in main, handlers that reach processing wait on a nil channel without it
+	configJobSlots()
+
+	os.Exit(m.Run())
+}
+
+func TestS3URLtoURI(t *testing.T) {
+
+	tests := []struct {
+		name   string
+		s3Url  string
+		bucket string
+		key    string
+	}{
+		{"s3 scheme", "s3://images/articles/cover.jpg", "images", "articles/cover.jpg"},
+		{"path-style global", "https://s3.amazonaws.com/images/articles/cover.jpg", "images", "articles/cover.jpg"},
+		{"path-style region", "https://s3.ap-south-1.amazonaws.com/images/articles/cover.jpg", "images", "articles/cover.jpg"},
+		{"path-style legacy region", "https://s3-eu-west-1.amazonaws.com/images/cover.jpg", "images", "cover.jpg"},
+		{"virtual-hosted global", "https://images.s3.amazonaws.com/articles/cover.jpg", "images", "articles/cover.jpg"},
+		{"virtual-hosted region", "https://images.s3.ap-south-1.amazonaws.com/articles/cover.jpg", "images", "articles/cover.jpg"},
+		{"virtual-hosted legacy region", "https://images.s3-us-west-2.amazonaws.com/cover.jpg", "images", "cover.jpg"},
+		{"virtual-hosted dotted bucket", "https://my.images.s3.ap-south-1.amazonaws.com/cover.jpg", "my.images", "cover.jpg"},
+		{"path-style dotted bucket", "https://s3.ap-south-1.amazonaws.com/my.images/cover.jpg", "my.images", "cover.jpg"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			s3map, err := S3URLtoURI(test.s3Url)
+
+			if err != nil {
+				t.Fatalf("S3URLtoURI(%q) returned error: %v", test.s3Url, err)
+			}
+
+			if s3map["bucket"] != test.bucket || s3map["key"] != test.key {
+				t.Errorf("S3URLtoURI(%q) = %q/%q, want %q/%q", test.s3Url, s3map["bucket"], s3map["key"], test.bucket, test.key)
+			}
+		})
+	}
+}
+
+func TestS3URLtoURIDottedBuckets(t *testing.T) {
+
+	tests := []struct {
+		s3Url  string
+		bucket string
+		key    string
+	}{
+		{"https://my.images.bucket.s3.amazonaws.com/cover.jpg", "my.images.bucket", "cover.jpg"},
+		{"https://my.images.bucket.s3.ap-south-1.amazonaws.com/a/cover.jpg", "my.images.bucket", "a/cover.jpg"},
+		{"https://my.images.bucket.s3-ap-south-1.amazonaws.com/cover.jpg", "my.images.bucket", "cover.jpg"},
+		{"https://my.images.bucket.s3.dualstack.us-east-1.amazonaws.com/cover.jpg", "my.images.bucket", "cover.jpg"},
+		{"https://my.images.bucket.s3.cn-north-1.amazonaws.com.cn/cover.jpg", "my.images.bucket", "cover.jpg"},
+		{"https://backup.s3.assets.s3.eu-west-1.amazonaws.com/cover.jpg", "backup.s3.assets", "cover.jpg"},
+		{"https://s3.amazonaws.com/my.images.bucket/cover.jpg", "my.images.bucket", "cover.jpg"},
+		{"https://s3.ap-south-1.amazonaws.com/my.images.bucket/a/cover.jpg", "my.images.bucket", "a/cover.jpg"},
+		{"https://s3-ap-south-1.amazonaws.com/my.images.bucket/cover.jpg", "my.images.bucket", "cover.jpg"},
+		{"https://s3.dualstack.us-east-1.amazonaws.com/my.images.bucket/cover.jpg", "my.images.bucket", "cover.jpg"},
+	}
+
+	for _, test := range tests {
+
+		s3map, err := S3URLtoURI(test.s3Url)
+
+		if err != nil {
+			t.Errorf("S3URLtoURI(%q) returned error: %v", test.s3Url, err)
+			continue
+		}
+
+		if s3map["bucket"] != test.bucket || s3map["key"] != test.key {
+			t.Errorf("S3URLtoURI(%q) = %q/%q, want %q/%q", test.s3Url, s3map["bucket"], s3map["key"], test.bucket, test.key)
+		}
+	}
+}
+
+func TestS3URLtoURIMissingKey(t *testing.T) {
+
+	for _, s3Url := range []string{
+		"https://s3.ap-south-1.amazonaws.com/images",
+		"https://s3.ap-south-1.amazonaws.com/images/",
+		"https://images.s3.ap-south-1.amazonaws.com/",
+		"s3://images",
+		"s3://images/",
+	} {
+		if _, err := S3URLtoURI(s3Url); err == nil {
+			t.Errorf("S3URLtoURI(%q) expected an error for a URL without a key", s3Url)
+		}
+	}
+}
+
+func TestS3URLtoURINonS3Hosts(t *testing.T) {
+
+	for _, s3Url := range []string{
+		"https://example.com/images/cover.jpg",
+		"https://images.example.com/cover.jpg",
+		"https://s3.example.com/images/cover.jpg",
+	} {
+		if _, err := S3URLtoURI(s3Url); err == nil {
+			t.Errorf("S3URLtoURI(%q) expected an error for a host that isn't S3", s3Url)
+		}
+	}
+}
+
+func TestS3URLtoURICustomEndpoint(t *testing.T) {
+
+	t.Setenv("S3_PUBLIC_URL", "https://cdn.example.com/storage")
+
+	s3map, err := S3URLtoURI("https://cdn.example.com/storage/images/articles/cover.jpg")
+
+	if err != nil {
+		t.Fatalf("S3URLtoURI returned error: %v", err)
+	}
+
+	if s3map["bucket"] != "images" || s3map["key"] != "articles/cover.jpg" {
+		t.Errorf("S3URLtoURI = %q/%q, want images/articles/cover.jpg", s3map["bucket"], s3map["key"])
+	}
+}
+
+func TestObjectURLWithCDN(t *testing.T) {
+
+	t.Setenv("AWS_BUCKET_NAME", "images")
+	t.Setenv("CDN_BASE_URL", "https://cdn.example.com/")
+
+	if got := objectURL("images", "articles/cover.webp"); got != "https://cdn.example.com/articles/cover.webp" {
+		t.Errorf("objectURL = %s, want the CDN URL", got)
+	}
+
+	// The CDN only fronts the default bucket
+	if got := objectURL("archive", "articles/cover.webp"); strings.HasPrefix(got, "https://cdn.example.com/") {
+		t.Errorf("objectURL = %s, want an S3 URL for another bucket", got)
+	}
+
+	s3map, err := S3URLtoURI("https://cdn.example.com/articles/cover.webp")
+
+	if err != nil || s3map["bucket"] != "images" || s3map["key"] != "articles/cover.webp" {
+		t.Errorf("S3URLtoURI of a CDN URL = %v, %v, want images/articles/cover.webp", s3map, err)
+	}
+}
+
+func TestS3URLtoURIUnsupportedScheme(t *testing.T) {
+
+	for _, s3Url := range []string{
+		"http://images.s3.ap-south-1.amazonaws.com/cover.jpg",
+		"ftp://images/cover.jpg",
+		"images/cover.jpg",
+		"/images/cover.jpg",
+		"",
+	} {
+		if _, err := S3URLtoURI(s3Url); err == nil {
+			t.Errorf("S3URLtoURI(%q) expected an error for an unsupported scheme", s3Url)
+		}
+	}
+}
+
+// objectStore keeping objects in memory and recording every call
+type fakeStore struct {
+	mutex       sync.Mutex
+	objects     map[string][]byte
+	downloadErr error
+	downloads   []string
+	uploads     []string
+	deletes     []string
+
+	// Uploads and deletes in the order they happened
+	operations []string
+}
+
+func newFakeStore() *fakeStore {
+	return &fakeStore{objects: map[string][]byte{}}
+}
+
+func (store *fakeStore) Download(ctx context.Context, bucket string, key string, maxBytes int64) ([]byte, error) {
+
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	store.downloads = append(store.downloads, bucket+"/"+key)
+
+	if store.downloadErr != nil {
+		return nil, store.downloadErr
+	}
+
+	body, found := store.objects[bucket+"/"+key]
+
+	if !found {
+		return nil, ErrSourceNotFound
+	}
+
+	if int64(len(body)) > maxBytes {
+		return nil, ErrImageTooLarge
+	}
+
+	return body, nil
+}
+
+func (store *fakeStore) Upload(ctx context.Context, bucket string, key string, body []byte, contentType string, metadata objectMetadata) error {
+
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	store.uploads = append(store.uploads, bucket+"/"+key)
+	store.operations = append(store.operations, "upload "+bucket+"/"+key)
+	store.objects[bucket+"/"+key] = body
+
+	return nil
+}
+
+func (store *fakeStore) Delete(ctx context.Context, bucket string, key string) error {
+
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	store.deletes = append(store.deletes, bucket+"/"+key)
+	store.operations = append(store.operations, "delete "+bucket+"/"+key)
+	delete(store.objects, bucket+"/"+key)
+
+	return nil
+}
+
+func (store *fakeStore) Presign(bucket string, key string, expiry time.Duration) (string, error) {
+	return "https://presigned.example.com/" + bucket + "/" + key, nil
+}
+
+func (store *fakeStore) List(ctx context.Context, bucket string, prefix string, keep func(key string) bool, maxKeys int) ([]string, bool, error) {
+
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	var keys []string
+
+	for name := range store.objects {
+		key := strings.TrimPrefix(name, bucket+"/")
+
+		if key == name || !strings.HasPrefix(key, prefix) || !keep(key) {
+			continue
+		}
+
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+
+	if len(keys) > maxKeys {
+		return keys[:maxKeys], true, nil
+	}
+
+	return keys, false, nil
+}
+
+// POST a JSON body to /optimize/ backed by the given store
+func postOptimize(t *testing.T, store objectStore, body string) (*httptest.ResponseRecorder, map[string]interface{}) {
+
+	t.Helper()
+
+	router := gin.New()
+	router.Use(RequestIDMiddleware())
+	router.POST("/optimize/", OptimizeImages(store))
+
+	recorder := httptest.NewRecorder()
+	request := httptest.NewRequest(http.MethodPost, "/optimize/", strings.NewReader(body))
+	request.Header.Set("Content-Type", "application/json")
+
+	router.ServeHTTP(recorder, request)
+
+	var response map[string]interface{}
+
+	if err := json.Unmarshal(recorder.Body.Bytes(), &response); err != nil {
+		t.Fatalf("response is not JSON: %v: %s", err, recorder.Body.String())
+	}
+
+	return recorder, response
+}
+
+func TestOptimizeImagesInvalidRequests(t *testing.T) {
+
+	tests := []struct {
+		name string
+		body string
+	}{
+		{"missing source", `{}`},
+		{"malformed json", `{"S3_URL":`},
+		{"unsupported format", `{"S3_URL": "s3://images/cover.jpg", "format": "bmp"}`},
+		{"quality out of range", `{"S3_URL": "s3://images/cover.jpg", "quality": 101}`},
+		{"source_url with S3_URL", `{"S3_URL": "s3://images/cover.jpg", "source_url": "https://cdn.example.com/cover.jpg"}`},
+		{"output_key with urls", `{"urls": ["s3://images/cover.jpg"], "output_key": "cover.webp"}`},
+		{"output_suffix with slash", `{"S3_URL": "s3://images/cover.jpg", "output_suffix": "/opt"}`},
+		{"invalid output_bucket", `{"S3_URL": "s3://images/cover.jpg", "output_bucket": "Not_A_Bucket"}`},
+		{"unsupported scheme", `{"S3_URL": "ftp://images/cover.jpg"}`},
+		{"in_place with another format", `{"S3_URL": "s3://images/cover.jpg", "in_place": true, "format": "webp"}`},
+		{"in_place with output_key", `{"S3_URL": "s3://images/cover.jpg", "in_place": true, "output_key": "cover.jpg"}`},
+		{"sizes with width", `{"S3_URL": "s3://images/cover.jpg", "sizes": [320, 640], "width": 320}`},
+		{"sizes repeating a width", `{"S3_URL": "s3://images/cover.jpg", "sizes": [320, 320]}`},
+		{"zero size", `{"S3_URL": "s3://images/cover.jpg", "sizes": [0]}`},
+		{"empty urls", `{"urls": []}`},
+		{"urls over the batch limit", `{"urls": ["s3://images/a.jpg", "s3://images/b.jpg", "s3://images/c.jpg"]}`},
+	}
+
+	t.Setenv("MAX_BATCH_URLS", "2")
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			store := newFakeStore()
+			recorder, response := postOptimize(t, store, test.body)
+
+			if recorder.Code != http.StatusBadRequest {
+				t.Errorf("status = %d, want %d: %v", recorder.Code, http.StatusBadRequest, response)
+			}
+
+			if response["error"] == nil {
+				t.Errorf("response has no error: %v", response)
+			}
+
+			if len(store.uploads) > 0 || len(store.deletes) > 0 {
+				t.Errorf("store was modified: uploads %v, deletes %v", store.uploads, store.deletes)
+			}
+		})
+	}
+}
+
+func TestOptimizeImagesDownloadFailures(t *testing.T) {
+
+	tests := []struct {
+		name        string
+		downloadErr error
+		status      int
+	}{
+		{"missing object", nil, http.StatusNotFound},
+		{"object too large", ErrImageTooLarge, http.StatusRequestEntityTooLarge},
+		{"s3 failure", errors.New("connection reset"), http.StatusInternalServerError},
+		{"deadline exceeded", context.DeadlineExceeded, http.StatusGatewayTimeout},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			store := newFakeStore()
+			store.downloadErr = test.downloadErr
+
+			recorder, response := postOptimize(t, store, `{"S3_URL": "s3://images/articles/cover.jpg"}`)
+
+			if recorder.Code != test.status {
+				t.Errorf("status = %d, want %d: %v", recorder.Code, test.status, response)
+			}
+
+			if response["stage"] != "download" {
+				t.Errorf("stage = %v, want download", response["stage"])
+			}
+
+			if len(store.downloads) != 1 || store.downloads[0] != "images/articles/cover.jpg" {
+				t.Errorf("downloads = %v, want [images/articles/cover.jpg]", store.downloads)
+			}
+
+			// The source must survive a failed optimization
+			if len(store.uploads) > 0 || len(store.deletes) > 0 {
+				t.Errorf("store was modified: uploads %v, deletes %v", store.uploads, store.deletes)
+			}
+		})
+	}
+}
+
+func TestOptimizeImagesBatchReportsEachURL(t *testing.T) {
+
+	store := newFakeStore()
+
+	recorder, response := postOptimize(t, store, `{"urls": ["s3://images/missing.jpg", "ftp://images/cover.jpg"]}`)
+
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d: %v", recorder.Code, http.StatusOK, response)
+	}
+
+	results, ok := response["results"].([]interface{})
+
+	if !ok || len(results) != 2 {
+		t.Fatalf("results = %v, want 2 entries", response["results"])
+	}
+
+	want := []struct {
+		url    string
+		status float64
+		stage  string
+	}{
+		{"s3://images/missing.jpg", http.StatusNotFound, "download"},
+		{"ftp://images/cover.jpg", http.StatusBadRequest, "request"},
+	}
+
+	for i, result := range results {
+		entry := result.(map[string]interface{})
+
+		if entry["S3_URL"] != want[i].url || entry["status"] != want[i].status || entry["stage"] != want[i].stage {
+			t.Errorf("results[%d] = %v, want S3_URL %s, status %v, stage %s", i, entry, want[i].url, want[i].status, want[i].stage)
+		}
+
+		if entry["error"] == nil {
+			t.Errorf("results[%d] has no error", i)
+		}
+	}
+
+	if len(store.downloads) != 1 {
+		t.Errorf("downloads = %v, want only the valid S3 url", store.downloads)
+	}
+}
+
+func TestBodyLimitMiddleware(t *testing.T) {
+
+	router := gin.New()
+	router.POST("/optimize/", BodyLimitMiddleware(64), OptimizeImages(newFakeStore()))
+
+	body := `{"S3_URL": "s3://images/` + strings.Repeat("a", 64) + `.jpg"}`
+
+	for _, contentLength := range []int64{int64(len(body)), -1} {
+		recorder := httptest.NewRecorder()
+		request := httptest.NewRequest(http.MethodPost, "/optimize/", strings.NewReader(body))
+		request.Header.Set("Content-Type", "application/json")
+
+		// -1 is a chunked body, only caught while it is read
+		request.ContentLength = contentLength
+
+		router.ServeHTTP(recorder, request)
+
+		if recorder.Code != http.StatusRequestEntityTooLarge {
+			t.Errorf("Content-Length %d: status = %d, want %d", contentLength, recorder.Code, http.StatusRequestEntityTooLarge)
+		}
+	}
+}
+
+func TestOptimizePrefixOptimizesImagesUnderPrefix(t *testing.T) {
+
+	store := newFakeStore()
+	store.downloadErr = errors.New("connection reset")
+
+	for _, name := range []string{"images/articles/b.png", "images/articles/a.jpg", "images/articles/c.webp", "images/articles/notes.txt", "images/other/c.jpg"} {
+		store.objects[name] = []byte("image")
+	}
+
+	router := gin.New()
+	router.POST("/optimize/prefix", OptimizePrefix(store))
+
+	recorder := httptest.NewRecorder()
+	request := httptest.NewRequest(http.MethodPost, "/optimize/prefix", strings.NewReader(`{"bucket": "images", "prefix": "articles/"}`))
+	request.Header.Set("Content-Type", "application/json")
+
+	router.ServeHTTP(recorder, request)
+
+	var response map[string]interface{}
+
+	if err := json.Unmarshal(recorder.Body.Bytes(), &response); err != nil {
+		t.Fatalf("response is not JSON: %v: %s", err, recorder.Body.String())
+	}
+
+	if recorder.Code != http.StatusAccepted || recorder.Header().Get("Location") != "/jobs/"+response["job_id"].(string) {
+		t.Fatalf("status = %d, Location = %q, want %d with the job: %v", recorder.Code, recorder.Header().Get("Location"), http.StatusAccepted, response)
+	}
+
+	// The batch runs in the background, the job holds the summary once done
+	runningJobs.Wait()
+
+	job, found := asyncJobs.get(response["job_id"].(string), "")
+
+	if !found || job.status != jobSucceeded {
+		t.Fatalf("job = %+v, want it succeeded", job)
+	}
+
+	if job.result["listed"] != 3 || job.result["failed"] != 3 || job.result["truncated"] != false {
+		t.Errorf("summary = %v, want 3 listed, 3 failed, not truncated", job.result)
+	}
+
+	if len(job.results) != 3 {
+		t.Fatalf("results = %v, want 3 entries", job.results)
+	}
+
+	for i, key := range []string{"articles/a.jpg", "articles/b.png", "articles/c.webp"} {
+		if entry := job.results[i]; entry["key"] != key || entry["stage"] != "download" {
+			t.Errorf("results[%d] = %v, want key %s failed in download", i, entry, key)
+		}
+	}
+
+	if len(store.uploads) > 0 || len(store.deletes) > 0 {
+		t.Errorf("store was modified: uploads %v, deletes %v", store.uploads, store.deletes)
+	}
+}
+
+func TestRecoveryMiddleware(t *testing.T) {
+
+	router := gin.New()
+	router.Use(RecoveryMiddleware())
+	router.GET("/panic", func(c *gin.Context) {
+		panic("corrupt image")
+	})
+
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/panic", nil))
+
+	if recorder.Code != http.StatusInternalServerError {
+		t.Errorf("status = %d, want %d", recorder.Code, http.StatusInternalServerError)
+	}
+
+	if !strings.Contains(recorder.Body.String(), `"error"`) {
+		t.Errorf("body = %s, want a JSON error", recorder.Body.String())
+	}
+}
+
+func TestContentAddressedKey(t *testing.T) {
+
+	// SHA-256 of "image"
+	const sum = "6105d6cc76af400325e94d588ce511be5bfdbb73b437dc51eca43917d7a43e3d"
+
+	if key := contentAddressedKey([]byte("image"), "webp"); key != sum+".webp" {
+		t.Errorf("key = %s, want %s.webp", key, sum)
+	}
+
+	t.Setenv("CONTENT_ADDRESSED_PREFIX", "/optimized/")
+
+	if key := contentAddressedKey([]byte("image"), "jpeg"); key != "optimized/"+sum+".jpg" {
+		t.Errorf("key = %s, want optimized/%s.jpg", key, sum)
+	}
+}
+
+func TestRequestSignatureMiddleware(t *testing.T) {
+
+	t.Setenv("REQUEST_SIGNING_SECRET", "signing-secret")
+
+	router := gin.New()
+	router.Use(RequestSignatureMiddleware(map[string]int64{"/optimize/upload": 1024}))
+	router.POST("/optimize/", func(c *gin.Context) {
+		c.Status(http.StatusNoContent)
+	})
+	router.POST("/optimize/upload", func(c *gin.Context) {
+		c.Status(http.StatusNoContent)
+	})
+
+	body := `{"S3_URL": "s3://images/cover.jpg"}`
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+
+	send := func(signature string, timestamp string) int {
+		recorder := httptest.NewRecorder()
+		request := httptest.NewRequest(http.MethodPost, "/optimize/", strings.NewReader(body))
+		request.Header.Set(requestSignatureHeader, signature)
+		request.Header.Set(requestTimestampHeader, timestamp)
+		request.Header.Set(requestNonceHeader, "nonce-1")
+
+		router.ServeHTTP(recorder, request)
+
+		return recorder.Code
+	}
+
+	signature := signPayload(requestSigningMessage(timestamp, "nonce-1", http.MethodPost, "/optimize/", []byte(body)), "signing-secret")
+
+	if code := send("sha256=0000", timestamp); code != http.StatusUnauthorized {
+		t.Errorf("wrong signature: status = %d, want %d", code, http.StatusUnauthorized)
+	}
+
+	if code := send(signature, "1"); code != http.StatusUnauthorized {
+		t.Errorf("expired timestamp: status = %d, want %d", code, http.StatusUnauthorized)
+	}
+
+	if code := send(signature, timestamp); code != http.StatusNoContent {
+		t.Errorf("valid signature: status = %d, want %d", code, http.StatusNoContent)
+	}
+
+	if code := send(signature, timestamp); code != http.StatusUnauthorized {
+		t.Errorf("replayed request: status = %d, want %d", code, http.StatusUnauthorized)
+	}
+
+	// Bodies are buffered up to the route's own limit, before the signature is checked
+	t.Setenv("MAX_BODY_BYTES", "16")
+
+	for path, size := range map[string]int{"/optimize/": 17, "/optimize/upload": 1025} {
+		recorder := httptest.NewRecorder()
+		request := httptest.NewRequest(http.MethodPost, path, strings.NewReader(strings.Repeat("x", size)))
+		request.Header.Set(requestTimestampHeader, timestamp)
+		request.Header.Set(requestNonceHeader, "nonce-2")
+
+		router.ServeHTTP(recorder, request)
+
+		if recorder.Code != http.StatusRequestEntityTooLarge {
+			t.Errorf("%d byte body on %s: status = %d, want %d", size, path, recorder.Code, http.StatusRequestEntityTooLarge)
+		}
+	}
+}
+
+func TestOptimizeResultReportsSourceAndOptimizedObjects(t *testing.T) {
+
+	s3map, err := S3URLtoURI("https://images.s3.ap-south-1.amazonaws.com/articles/cover.jpg")
+
+	if err != nil {
+		t.Fatalf("S3URLtoURI returned error: %v", err)
+	}
+
+	result := optimizeResult{
+		url:    "https://s3.ap-south-1.amazonaws.com/optimized/articles/cover.webp",
+		bucket: "optimized",
+		key:    "articles/cover.webp",
+		source: sourceObject("https://images.s3.ap-south-1.amazonaws.com/articles/cover.jpg", s3map, optimizeOptions{}),
+	}
+
+	response := result.addTo(gin.H{})
+
+	want := gin.H{
+		"source_url":       "s3://images/articles/cover.jpg",
+		"source_bucket":    "images",
+		"source_key":       "articles/cover.jpg",
+		"optimized_url":    result.url,
+		"optimized_bucket": "optimized",
+		"optimized_key":    "articles/cover.webp",
+	}
+
+	for field, value := range want {
+		if response[field] != value {
+			t.Errorf("%s = %v, want %v", field, response[field], value)
+		}
+	}
+}
+
+func TestHandleEnvVariablesConcurrentReads(t *testing.T) {
+
+	t.Setenv("AWS_REGION", "eu-west-1")
+
+	var wg sync.WaitGroup
+
+	// Run with -race, lookups must not write to viper once it is set up
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			for j := 0; j < 100; j++ {
+				if region := getAWSRegion(); region != "eu-west-1" {
+					t.Errorf("region = %s, want eu-west-1", region)
+					return
+				}
+			}
+		}()
+	}
+
+	wg.Wait()
+}
+
+func TestNegotiateFormatSkipsUnavailableFormats(t *testing.T) {
+
+	defer func(formats map[string]bool) { availableFormats = formats }(availableFormats)
+
+	// A build without libheif can't encode AVIF, the next accepted format is picked
+	availableFormats = map[string]bool{"jpeg": true, "png": true, "webp": true}
+
+	tests := map[string]string{
+		"image/avif,image/webp,*/*": "webp",
+		"image/avif,image/png":      "original",
+		"image/avif,*/*":            "",
+	}
+
+	for accept, want := range tests {
+		if format := negotiateFormat(accept); format != want {
+			t.Errorf("negotiateFormat(%q) = %q, want %q", accept, format, want)
+		}
+	}
+}
+
+func TestDownloadHTTPFileRefusesInternalAddresses(t *testing.T) {
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("image"))
+	}))
+	defer server.Close()
+
+	// The test server listens on loopback, like a service next to this one would
+	sources := []string{
+		server.URL + "/cover.jpg",
+		"http://169.254.169.254/latest/meta-data/",
+		"http://[::1]/cover.jpg",
+		"http://localhost/cover.jpg",
+	}
+
+	for _, source := range sources {
+		if _, err := DownloadHTTPFile(context.Background(), source, 1024); !errors.Is(err, ErrPrivateAddress) {
+			t.Errorf("DownloadHTTPFile(%s) error = %v, want %v", source, err, ErrPrivateAddress)
+		}
+	}
+}
+
+func TestCheckRedirectRefusesInternalAddresses(t *testing.T) {
+
+	hops := map[string]bool{
+		"https://images.example.com/cover.jpg": true,
+		"http://10.0.0.5/cover.jpg":            false,
+		"http://169.254.169.254/":              false,
+		"file:///etc/passwd":                   false,
+	}
+
+	for target, allowed := range hops {
+		request := httptest.NewRequest(http.MethodGet, target, nil)
+
+		if err := checkRedirect(request, nil); (err == nil) != allowed {
+			t.Errorf("checkRedirect(%s) error = %v, want allowed %v", target, err, allowed)
+		}
+	}
+}
+
+func TestPublicAddress(t *testing.T) {
+
+	addresses := map[string]bool{
+		"93.184.216.34":   true,
+		"2606:4700::1111": true,
+		"127.0.0.1":       false,
+		"10.1.2.3":        false,
+		"172.16.0.1":      false,
+		"192.168.1.1":     false,
+		"169.254.169.254": false,
+		"100.64.0.1":      false,
+		"0.0.0.0":         false,
+		"::1":             false,
+		"fd00:ec2::254":   false,
+		"fe80::1":         false,
+	}
+
+	for address, public := range addresses {
+		if got := publicAddress(net.ParseIP(address)); got != public {
+			t.Errorf("publicAddress(%s) = %v, want %v", address, got, public)
+		}
+	}
+}
+
+func TestValidCallbackURL(t *testing.T) {
+
+	callbacks := map[string]bool{
+		"https://hooks.example.com/jobs":         true,
+		"http://hooks.example.com/jobs":          false,
+		"https://127.0.0.1/jobs":                 false,
+		"https://169.254.169.254/latest/api/tok": false,
+		"ftp://hooks.example.com/jobs":           false,
+		"/jobs":                                  false,
+	}
+
+	for callback, valid := range callbacks {
+		if got := validCallbackURL(callback); got != valid {
+			t.Errorf("validCallbackURL(%s) = %v, want %v", callback, got, valid)
+		}
+	}
+
+	t.Setenv("CALLBACK_ALLOW_HTTP", "true")
+
+	if !validCallbackURL("http://hooks.example.com/jobs") {
+		t.Error("http callback refused with CALLBACK_ALLOW_HTTP=true")
+	}
+}
+
+func TestJobStoreLimitsPendingJobs(t *testing.T) {
+
+	store := &jobStore{jobs: map[string]*asyncJob{}}
+
+	first, created := store.create("token", 2)
+	if !created {
+		t.Fatal("first job refused")
+	}
+
+	if _, created := store.create("token", 2); !created {
+		t.Fatal("second job refused")
+	}
+
+	if _, created := store.create("token", 2); created {
+		t.Error("third job accepted past the limit")
+	}
+
+	// A finished job frees its place in the queue
+	store.finish(first.id, http.StatusCreated, nil, nil, nil, time.Minute)
+
+	if _, created := store.create("token", 2); !created {
+		t.Error("job refused after one finished")
+	}
+}
+
+func TestWaitForJobs(t *testing.T) {
+
+	release := make(chan struct{})
+
+	runningJobs.Add(1)
+
+	go func() {
+		defer runningJobs.Done()
+		<-release
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	if waitForJobs(ctx) {
+		t.Error("waitForJobs returned true with a job still running")
+	}
+
+	close(release)
+
+	if !waitForJobs(context.Background()) {
+		t.Error("waitForJobs returned false once jobs finished")
+	}
+}
+
+func TestIdempotencyMiddleware(t *testing.T) {
+
+	calls := 0
+
+	router := gin.New()
+	router.Use(IdempotencyMiddleware())
+	router.POST("/optimize/", func(c *gin.Context) {
+		calls++
+		c.JSON(http.StatusCreated, gin.H{"call": calls})
+	})
+	router.POST("/optimize/upload", func(c *gin.Context) {
+		calls++
+		c.Data(http.StatusOK, "image/webp", []byte("webp"))
+	})
+
+	send := func(path string, key string, body string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		request := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+		request.Header.Set(idempotencyKeyHeader, key)
+
+		router.ServeHTTP(recorder, request)
+
+		return recorder
+	}
+
+	first := send("/optimize/", "key-1", `{"S3_URL": "s3://images/a.jpg"}`)
+	replayed := send("/optimize/", "key-1", `{"S3_URL": "s3://images/a.jpg"}`)
+
+	if calls != 1 || replayed.Body.String() != first.Body.String() || replayed.Header().Get("Idempotent-Replayed") != "true" {
+		t.Errorf("calls = %d, replayed %q, want one call replaying %q", calls, replayed.Body.String(), first.Body.String())
+	}
+
+	if recorder := send("/optimize/", "key-1", `{"S3_URL": "s3://images/b.jpg"}`); recorder.Code != http.StatusUnprocessableEntity {
+		t.Errorf("reused key with another body: status = %d, want %d", recorder.Code, http.StatusUnprocessableEntity)
+	}
+
+	// Binary responses aren't kept, the request runs again
+	send("/optimize/upload", "key-2", "image")
+	send("/optimize/upload", "key-2", "image")
+
+	if calls != 3 {
+		t.Errorf("calls = %d, want the binary response processed twice", calls)
+	}
+}
+
+func TestIdempotencyStoreEvictsOldest(t *testing.T) {
+
+	store := &idempotencyStore{entries: map[string]*idempotentResponse{}, maxEntries: 2, maxBytes: 10}
+	hash := sha256.Sum256(nil)
+
+	for i, key := range []string{"a", "b", "c"} {
+		store.begin(key, hash, time.Duration(i+1)*time.Minute)
+		store.finish(key, http.StatusCreated, "application/json", "", []byte("1234"))
+	}
+
+	if _, found := store.entries["a"]; found || len(store.entries) != 2 {
+		t.Errorf("entries = %v, want the oldest evicted past 2 entries", store.entries)
+	}
+
+	// A body that doesn't fit next to the others evicts them, one over the limit isn't kept
+	store.begin("d", hash, time.Hour)
+	store.finish("d", http.StatusCreated, "application/json", "", []byte("12345678"))
+
+	if store.bytes > store.maxBytes {
+		t.Errorf("bytes = %d, want at most %d", store.bytes, store.maxBytes)
+	}
+
+	store.begin("e", hash, time.Hour)
+	store.finish("e", http.StatusCreated, "application/json", "", []byte("12345678901"))
+
+	if _, found := store.entries["e"]; found {
+		t.Error("body over the byte limit was kept")
+	}
+}
+
+func TestMethodNotAllowedListsMatchingRoutes(t *testing.T) {
+
+	router := gin.New()
+	router.HandleMethodNotAllowed = true
+	router.GET("/jobs/:id", JobStatus)
+	router.GET("/debug/pprof/*profile", Pprof)
+	router.POST("/debug/pprof/*profile", Pprof)
+	router.POST("/optimize/", OptimizeImages(newFakeStore()))
+	router.NoMethod(MethodNotAllowed(router))
+
+	tests := []struct {
+		method string
+		path   string
+		allow  string
+	}{
+		{http.MethodDelete, "/jobs/abc", "GET"},
+		{http.MethodGet, "/optimize/", "POST"},
+		{http.MethodPut, "/debug/pprof/symbol", "GET, POST"},
+	}
+
+	for _, test := range tests {
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest(test.method, test.path, nil))
+
+		if recorder.Code != http.StatusMethodNotAllowed || recorder.Header().Get("Allow") != test.allow {
+			t.Errorf("%s %s: status = %d, Allow = %q, want %d with %q", test.method, test.path, recorder.Code, recorder.Header().Get("Allow"), http.StatusMethodNotAllowed, test.allow)
+		}
+	}
+}
+
+func TestMetricsAreGzippedOnce(t *testing.T) {
+
+	router := gin.New()
+	router.Use(GzipMiddleware(gzip.DefaultCompression))
+	router.GET("/metrics", gin.WrapH(promhttp.Handler()))
+
+	recorder := httptest.NewRecorder()
+	request := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	request.Header.Set("Accept-Encoding", "gzip")
+
+	router.ServeHTTP(recorder, request)
+
+	// Scrapers gunzip once, the result must be the text exposition format
+	reader, err := stdgzip.NewReader(recorder.Body)
+	if err != nil {
+		t.Fatalf("response is not gzipped: %v", err)
+	}
+
+	families, err := new(expfmt.TextParser).TextToMetricFamilies(reader)
+	if err != nil {
+		t.Fatalf("parsing metrics: %v", err)
+	}
+
+	if len(families) == 0 {
+		t.Error("no metric families scraped")
+	}
+}
+
+func TestPprofSymbolLookup(t *testing.T) {
+
+	router := gin.New()
+	router.GET("/debug/pprof/*profile", Pprof)
+	router.POST("/debug/pprof/*profile", Pprof)
+
+	// go tool pprof posts the addresses to resolve, "+" separated
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/debug/pprof/symbol", strings.NewReader("0x0")))
+
+	if recorder.Code != http.StatusOK || !strings.HasPrefix(recorder.Body.String(), "num_symbols:") {
+		t.Errorf("status = %d, body = %q, want 200 with a symbol table", recorder.Code, recorder.Body.String())
+	}
+}
+
+func TestOptimizeImagesVariesOnAccept(t *testing.T) {
+
+	store := newFakeStore()
+	store.downloadErr = errors.New("connection reset")
+
+	tests := map[string]string{
+		`{"S3_URL": "s3://images/cover.jpg"}`:                   "Accept",
+		`{"S3_URL": "s3://images/cover.jpg", "format": "jpeg"}`: "",
+	}
+
+	for body, vary := range tests {
+		recorder, _ := postOptimize(t, store, body)
+
+		if got := recorder.Header().Get("Vary"); got != vary {
+			t.Errorf("%s: Vary = %q, want %q", body, got, vary)
+		}
+	}
+}
+
+func TestRequestOptionsIgnoresAccept(t *testing.T) {
+
+	defer func(formats map[string]bool) { availableFormats = formats }(availableFormats)
+
+	availableFormats = map[string]bool{"avif": true, "webp": true, "jpeg": true}
+
+	// Prefix and async jobs share requestOptions, an Accept header must not re-encode them
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest(http.MethodPost, "/optimize/prefix", nil)
+	c.Request.Header.Set("Accept", "image/avif")
+
+	options, err := requestOptions(c, &OptimizeRequest{URLs: []string{}})
+	if err != nil {
+		t.Fatalf("requestOptions returned error: %v", err)
+	}
+
+	if options.format == "avif" {
+		t.Error("Accept header picked the format outside /optimize/")
+	}
+}
+
+func TestCORSAllowsSignatureHeaders(t *testing.T) {
+
+	t.Setenv("CORS_ALLOWED_ORIGINS", "https://app.example.com")
+
+	router := gin.New()
+	router.Use(CORSMiddleware())
+	router.POST("/optimize/", func(c *gin.Context) {
+		c.Status(http.StatusNoContent)
+	})
+
+	recorder := httptest.NewRecorder()
+	request := httptest.NewRequest(http.MethodOptions, "/optimize/", nil)
+	request.Header.Set("Origin", "https://app.example.com")
+	request.Header.Set("Access-Control-Request-Method", http.MethodPost)
+
+	router.ServeHTTP(recorder, request)
+
+	allowed := recorder.Header().Get("Access-Control-Allow-Headers")
+
+	for _, header := range []string{requestSignatureHeader, requestTimestampHeader, requestNonceHeader, "X-Debug"} {
+		if !strings.Contains(allowed, header) {
+			t.Errorf("Access-Control-Allow-Headers = %q, want it to include %s", allowed, header)
+		}
+	}
+}
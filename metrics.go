@@ -0,0 +1,59 @@
+package main
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	optimizationsTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "image_optimizations_total",
+		Help: "Number of image optimizations attempted.",
+	})
+
+	optimizationFailuresTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "image_optimization_failures_total",
+		Help: "Number of failed image optimizations by the stage that failed.",
+	}, []string{"stage"})
+
+	optimizationPhaseDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "image_optimization_phase_duration_seconds",
+		Help:    "Time spent downloading, processing and uploading images.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"phase"})
+
+	optimizationSavedRatio = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "image_optimization_bytes_saved_ratio",
+		Help:    "Share of the original size saved by optimization, negative when the output grew.",
+		Buckets: prometheus.LinearBuckets(-0.5, 0.1, 16),
+	})
+)
+
+// Count an optimization, and its failure stage when err is set
+func recordOptimization(stage string, err error) {
+
+	optimizationsTotal.Inc()
+
+	if err != nil {
+		optimizationFailuresTotal.WithLabelValues(stage).Inc()
+	}
+}
+
+func observePhase(phase string, start time.Time) time.Duration {
+
+	elapsed := time.Since(start)
+	optimizationPhaseDuration.WithLabelValues(phase).Observe(elapsed.Seconds())
+
+	return elapsed
+}
+
+func observeSavedRatio(originalBytes int, optimizedBytes int) {
+
+	if originalBytes < 1 {
+		return
+	}
+
+	optimizationSavedRatio.Observe(float64(originalBytes-optimizedBytes) / float64(originalBytes))
+}
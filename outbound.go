@@ -0,0 +1,112 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"syscall"
+	"time"
+)
+
+// Returned when a source or callback URL would reach the service's own network
+var ErrPrivateAddress = errors.New("address is not publicly routable")
+
+// Ranges not covered by net.IP's helpers: carrier-grade NAT and the IPv6 form of
+// the cloud metadata endpoint (169.254.169.254 itself is link-local)
+var blockedNetworks = []*net.IPNet{
+	mustParseCIDR("100.64.0.0/10"),
+	mustParseCIDR("fd00:ec2::254/128"),
+}
+
+func mustParseCIDR(cidr string) *net.IPNet {
+
+	_, network, err := net.ParseCIDR(cidr)
+	if err != nil {
+		panic(err)
+	}
+
+	return network
+}
+
+// Loopback, private, link-local (including the metadata endpoint) and unspecified
+// addresses are refused
+func publicAddress(ip net.IP) bool {
+
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified() {
+		return false
+	}
+
+	for _, network := range blockedNetworks {
+		if network.Contains(ip) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Runs on every connection after DNS resolution, so a hostname resolving (or
+// re-resolving between checks) to an internal address is refused
+func dialPublicOnly(network string, address string, _ syscall.RawConn) error {
+
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+
+	if ip := net.ParseIP(host); ip == nil || !publicAddress(ip) {
+		return fmt.Errorf("%w: %s", ErrPrivateAddress, host)
+	}
+
+	return nil
+}
+
+// Only absolute http(s) URLs, and hosts given as an IP must be public
+func checkPublicURL(target *url.URL) error {
+
+	if (target.Scheme != "http" && target.Scheme != "https") || target.Hostname() == "" {
+		return fmt.Errorf("unsupported URL %q", target.Redacted())
+	}
+
+	if ip := net.ParseIP(target.Hostname()); ip != nil && !publicAddress(ip) {
+		return fmt.Errorf("%w: %s", ErrPrivateAddress, ip)
+	}
+
+	return nil
+}
+
+// Each redirect hop is checked like the first URL, its connection goes through the dialer guard too
+func checkRedirect(request *http.Request, via []*http.Request) error {
+
+	if len(via) >= 10 {
+		return errors.New("stopped after 10 redirects")
+	}
+
+	return checkPublicURL(request.URL)
+}
+
+// HTTP client for URLs given by API callers, source images and callbacks. It
+// never connects to internal addresses and ignores proxy env vars, a proxy would
+// make the connection on its behalf.
+var publicHTTPClient = newPublicHTTPClient()
+
+func newPublicHTTPClient() *http.Client {
+
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+		Control:   dialPublicOnly,
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+
+	return &http.Client{
+		Transport:     transport,
+		CheckRedirect: checkRedirect,
+	}
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"net/http/pprof"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Profiling is off unless ENABLE_PPROF is true
+func pprofEnabled() bool {
+
+	enabled, err := strconv.ParseBool(handleEnvVariables("ENABLE_PPROF"))
+
+	return err == nil && enabled
+}
+
+// Serve net/http/pprof under /debug/pprof/, mounted behind the API token middleware.
+// Named profiles like heap or goroutine go through the index handler.
+func Pprof(c *gin.Context) {
+
+	switch strings.TrimPrefix(c.Param("profile"), "/") {
+	case "cmdline":
+		pprof.Cmdline(c.Writer, c.Request)
+	case "profile":
+		pprof.Profile(c.Writer, c.Request)
+	case "symbol":
+		pprof.Symbol(c.Writer, c.Request)
+	case "trace":
+		pprof.Trace(c.Writer, c.Request)
+	default:
+		pprof.Index(c.Writer, c.Request)
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Most images one prefix request handles, 1000 by default
+func getMaxPrefixObjects() int {
+	return int(handleIntEnvVariable("MAX_PREFIX_OBJECTS", 1000))
+}
+
+// Images of a prefix optimized at once, the job slots still bound the processing
+func getPrefixConcurrency() int {
+	return int(handleIntEnvVariable("PREFIX_CONCURRENCY", 4))
+}
+
+// Body of a prefix request, the image options apply to every object found
+type PrefixRequest struct {
+	ImageOptions
+
+	Bucket       string `json:"bucket" binding:"required"`
+	Prefix       string `json:"prefix"`
+	KeepOriginal bool   `json:"keep_original"`
+	OutputSuffix string `json:"output_suffix"`
+	OutputBucket string `json:"output_bucket"`
+
+	// Stored with the optimized objects, Cache-Control defaults to S3_CACHE_CONTROL
+	CacheControl string            `json:"cache_control"`
+	Metadata     map[string]string `json:"metadata"`
+
+	DryRun       bool  `json:"dry_run"`
+	SkipIfLarger *bool `json:"skip_if_larger"`
+}
+
+// Only objects with an image extension are optimized
+func isImageKey(key string) bool {
+	return imageExtensions[strings.ToLower(path.Ext(key))]
+}
+
+// S3 URL of an object, the key is escaped so names with ? or % survive parsing
+func s3ObjectURL(bucket string, key string) string {
+	return (&url.URL{Scheme: "s3", Host: bucket, Path: "/" + key}).String()
+}
+
+// Optimize every image under a bucket prefix in the background. Responds 202 with
+// the job ID to poll on /jobs/:id, whose result is the summary.
+func OptimizePrefix(store objectStore) gin.HandlerFunc {
+
+	return func(c *gin.Context) {
+
+		var request PrefixRequest
+
+		if err := c.ShouldBindJSON(&request); err != nil {
+			respondWithError(c, bindErrorStatus(err), err.Error())
+			return
+		}
+
+		if !bucketNamePattern.MatchString(request.Bucket) {
+			respondWithError(c, http.StatusBadRequest, "bucket is not a valid S3 bucket name")
+			return
+		}
+
+		// Validated like a batch, so options that only make sense for one image are refused
+		options, err := requestOptions(c, &OptimizeRequest{
+			ImageOptions: request.ImageOptions,
+			URLs:         []string{},
+			KeepOriginal: request.KeepOriginal,
+			OutputSuffix: request.OutputSuffix,
+			OutputBucket: request.OutputBucket,
+			CacheControl: request.CacheControl,
+			Metadata:     request.Metadata,
+			DryRun:       request.DryRun,
+			SkipIfLarger: request.SkipIfLarger,
+		})
+		if err != nil {
+			respondWithError(c, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		prefix := strings.TrimLeft(request.Prefix, "/")
+
+		startJob(c, func(ctx context.Context, id string, requestID string) {
+			runPrefixJob(ctx, store, id, requestID, request.Bucket, prefix, options)
+		})
+	}
+}
+
+// List and optimize a prefix, the job's result is the summary and its results one
+// entry per key. Objects are listed page by page up to MAX_PREFIX_OBJECTS,
+// "truncated" tells when more were left.
+func runPrefixJob(ctx context.Context, store objectStore, id string, requestID string, bucket string, prefix string, options optimizeOptions) {
+
+	keys, truncated, err := store.List(ctx, bucket, prefix, isImageKey, getMaxPrefixObjects())
+	if err != nil {
+		asyncJobs.finish(id, s3ErrorStatus(err), err, nil, nil, getJobTTL())
+		return
+	}
+
+	results := optimizeKeys(ctx, store, requestID, bucket, keys, options)
+
+	summary := gin.H{"optimized": 0, "skipped": 0, "failed": 0}
+
+	for _, result := range results {
+		switch {
+		case result["error"] != nil:
+			summary["failed"] = summary["failed"].(int) + 1
+		case result["skipped"] == true:
+			summary["skipped"] = summary["skipped"].(int) + 1
+		default:
+			summary["optimized"] = summary["optimized"].(int) + 1
+		}
+	}
+
+	summary["bucket"] = bucket
+	summary["prefix"] = prefix
+	summary["listed"] = len(keys)
+	summary["truncated"] = truncated
+
+	asyncJobs.finish(id, http.StatusOK, nil, summary, results, getJobTTL())
+}
+
+// Optimize the keys with up to PREFIX_CONCURRENCY workers, results keep the key order
+func optimizeKeys(ctx context.Context, store objectStore, requestID string, bucket string, keys []string, options optimizeOptions) []gin.H {
+
+	results := make([]gin.H, len(keys))
+	indexes := make(chan int)
+
+	var workers sync.WaitGroup
+
+	for worker := 0; worker < getPrefixConcurrency(); worker++ {
+		workers.Add(1)
+
+		go func() {
+			defer workers.Done()
+
+			for index := range indexes {
+				s3Url := s3ObjectURL(bucket, keys[index])
+				result, code, err := optimizeAndLog(ctx, store, requestID, s3Url, options)
+
+				if err != nil {
+					results[index] = errorFields(err, gin.H{"key": keys[index], "status": code})
+					continue
+				}
+
+				results[index] = result.addTo(gin.H{"key": keys[index], "status": code})
+			}
+		}()
+	}
+
+	for index := range keys {
+		indexes <- index
+	}
+
+	close(indexes)
+	workers.Wait()
+
+	return results
+}
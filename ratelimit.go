@@ -0,0 +1,93 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Requests a client may still make, refilled continuously at the configured rate
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// Buckets by API token, only valid tokens get here so the map stays small
+type rateLimiter struct {
+	mutex   sync.Mutex
+	rate    float64
+	burst   float64
+	buckets map[string]*tokenBucket
+}
+
+// Take one request from the client's bucket, returns how long to wait when it is empty
+func (limiter *rateLimiter) allow(key string) (bool, time.Duration) {
+
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+
+	now := time.Now()
+	bucket, found := limiter.buckets[key]
+
+	if !found {
+		bucket = &tokenBucket{tokens: limiter.burst, updated: now}
+		limiter.buckets[key] = bucket
+	}
+
+	bucket.tokens = math.Min(limiter.burst, bucket.tokens+now.Sub(bucket.updated).Seconds()*limiter.rate)
+	bucket.updated = now
+
+	if bucket.tokens < 1 {
+		return false, time.Duration((1 - bucket.tokens) / limiter.rate * float64(time.Second))
+	}
+
+	bucket.tokens--
+
+	return true, 0
+}
+
+// Requests per second allowed for each API token, 0 (the default) disables the limit
+func getRateLimit() int64 {
+	return handleIntEnvVariable("RATE_LIMIT_PER_SECOND", 0)
+}
+
+// Requests a token can make at once after being idle, defaults to the per second rate
+func getRateLimitBurst(rate int64) int64 {
+	return handleIntEnvVariable("RATE_LIMIT_BURST", rate)
+}
+
+// Limit each API token to RATE_LIMIT_PER_SECOND requests so one heavy client can't
+// take all the processing slots. Runs after APITokenMiddleware.
+func RateLimitMiddleware() gin.HandlerFunc {
+
+	rate := getRateLimit()
+
+	if rate == 0 {
+		return func(c *gin.Context) {
+			c.Next()
+		}
+	}
+
+	limiter := &rateLimiter{
+		rate:    float64(rate),
+		burst:   float64(getRateLimitBurst(rate)),
+		buckets: map[string]*tokenBucket{},
+	}
+
+	return func(c *gin.Context) {
+
+		allowed, wait := limiter.allow(requestToken(c))
+
+		if !allowed {
+			c.Header("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			respondWithError(c, http.StatusTooManyRequests, "Rate limit exceeded, try again later")
+			return
+		}
+
+		c.Next()
+	}
+}
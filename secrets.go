@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+// API token read from Secrets Manager at startup, takes the place of API_TOKEN
+var secretAPIToken string
+
+// Fetch the API token from the secret in API_TOKEN_SECRET_ARN, with the same
+// credentials as S3. The secret is either the token itself or JSON with an
+// API_TOKEN field. Nothing to do when the ARN isn't set.
+func configAPITokenSecret() error {
+
+	arn := handleEnvVariables("API_TOKEN_SECRET_ARN")
+
+	if arn == "" {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	output, err := secretsmanager.NewFromConfig(awsConfig).GetSecretValue(ctx, &secretsmanager.GetSecretValueInput{
+		SecretId: aws.String(arn),
+	})
+	if err != nil {
+		return err
+	}
+
+	secretAPIToken = strings.TrimSpace(aws.StringValue(output.SecretString))
+
+	var fields map[string]string
+
+	if json.Unmarshal([]byte(secretAPIToken), &fields) == nil {
+		secretAPIToken = fields["API_TOKEN"]
+	}
+
+	if secretAPIToken == "" {
+		return errors.New("secret has no API token")
+	}
+
+	return nil
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// One width of a responsive set
+type sizedImage struct {
+	width          uint
+	height         uint
+	url            string
+	key            string
+	optimizedBytes int
+}
+
+// Optimize one source into several widths, stored as "<key><suffix>_<width>.<ext>".
+// The source is downloaded once and only deleted after every width is stored.
+func optimizeSizes(ctx context.Context, store objectStore, sourceUrl string, options optimizeOptions) (result optimizeResult, code int, err error) {
+
+	stage := "request"
+	timings := map[string]int64{}
+
+	defer func() {
+		recordOptimization(stage, err)
+
+		if err != nil {
+			err = &stageError{stage: stage, err: err}
+		}
+
+		if err == nil && options.debug {
+			result.timings = timings
+		}
+	}()
+
+	s3map, err := sourceLocation(sourceUrl, options)
+	if err != nil {
+		return optimizeResult{}, http.StatusBadRequest, err
+	}
+
+	stage = "download"
+	start := time.Now()
+
+	fileBytes, code, err := downloadSource(ctx, store, sourceUrl, s3map, options)
+	if err != nil {
+		return optimizeResult{}, code, err
+	}
+
+	timings["download_ms"] = observePhase("download", start).Milliseconds()
+
+	optimizedBucket := handleEnvVariables("AWS_BUCKET_NAME")
+
+	if options.outputBucket != "" {
+		optimizedBucket = options.outputBucket
+	}
+
+	result.originalBytes = len(fileBytes)
+	result.source = sourceObject(sourceUrl, s3map, options)
+	result.bucket = optimizedBucket
+
+	for _, width := range options.sizes {
+		stage = "process"
+		start = time.Now()
+
+		sizeOptions := options
+		sizeOptions.width, sizeOptions.height = width, 0
+
+		code, err = acquireJobSlot(ctx)
+		if err != nil {
+			return optimizeResult{}, code, err
+		}
+
+		var processed processedImage
+
+		processed, code, err = processImage(fileBytes, sizeOptions)
+		releaseJobSlot()
+
+		if err != nil {
+			return optimizeResult{}, code, err
+		}
+
+		timings["process_ms"] += observePhase("process", start).Milliseconds()
+
+		if ctx.Err() != nil {
+			return optimizeResult{}, http.StatusGatewayTimeout, ctx.Err()
+		}
+
+		name := optimizedKey(s3map["key"], options.outputSuffix+"_"+strconv.FormatUint(uint64(width), 10), processed.format)
+
+		if options.contentAddressed {
+			name = contentAddressedKey(processed.blob, processed.format)
+		}
+
+		sized := sizedImage{
+			width:          processed.width,
+			height:         processed.height,
+			url:            objectURL(optimizedBucket, name),
+			key:            name,
+			optimizedBytes: len(processed.blob),
+		}
+
+		if !options.dryRun {
+			stage = "upload"
+			start = time.Now()
+
+			err = store.Upload(ctx, optimizedBucket, name, processed.blob, supportedFormats[processed.format].contentType, options.objectMetadata)
+			if err != nil {
+				return optimizeResult{}, s3ErrorStatus(err), err
+			}
+
+			timings["upload_ms"] += observePhase("upload", start).Milliseconds()
+
+			if options.presign > 0 {
+				stage = "presign"
+
+				sized.url, err = store.Presign(optimizedBucket, name, options.presign)
+				if err != nil {
+					return optimizeResult{}, http.StatusInternalServerError, err
+				}
+			}
+
+			observeSavedRatio(len(fileBytes), sized.optimizedBytes)
+		}
+
+		if result.sizes == nil {
+			result.url, result.key = sized.url, sized.key
+			result.optimizedBytes = sized.optimizedBytes
+			result.width, result.height = sized.width, sized.height
+			result.inputFormat, result.format = processed.inputFormat, processed.format
+		}
+
+		result.sizes = append(result.sizes, sized)
+	}
+
+	// Every width has its own key, so the source is never replaced in place
+	if !options.keepOriginal && !options.dryRun && !options.httpSource {
+		stage = "delete"
+		start = time.Now()
+
+		err = store.Delete(ctx, s3map["bucket"], s3map["key"])
+		if err != nil {
+			return optimizeResult{}, s3ErrorStatus(err), err
+		}
+
+		timings["delete_ms"] = observePhase("delete", start).Milliseconds()
+	}
+
+	return result, http.StatusOK, nil
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// Object storage used by the optimize handlers, S3 in production and a fake in tests
+type objectStore interface {
+	Download(ctx context.Context, bucket string, key string, maxBytes int64) ([]byte, error)
+	Upload(ctx context.Context, bucket string, key string, body []byte, contentType string, metadata objectMetadata) error
+	Delete(ctx context.Context, bucket string, key string) error
+	Presign(bucket string, key string, expiry time.Duration) (string, error)
+	List(ctx context.Context, bucket string, prefix string, keep func(key string) bool, maxKeys int) ([]string, bool, error)
+}
+
+// objectStore backed by an S3 client
+type s3Store struct {
+	client *s3.Client
+}
+
+func (store s3Store) Download(ctx context.Context, bucket string, key string, maxBytes int64) ([]byte, error) {
+	return DownloadS3File(ctx, key, bucket, store.client, maxBytes)
+}
+
+func (store s3Store) Upload(ctx context.Context, bucket string, key string, body []byte, contentType string, metadata objectMetadata) error {
+	return UploadS3File(ctx, key, bucket, store.client, body, contentType, metadata)
+}
+
+func (store s3Store) Delete(ctx context.Context, bucket string, key string) error {
+	return DeleteS3File(ctx, key, bucket, store.client)
+}
+
+func (store s3Store) Presign(bucket string, key string, expiry time.Duration) (string, error) {
+	return PresignS3File(key, bucket, store.client, expiry)
+}
+
+func (store s3Store) List(ctx context.Context, bucket string, prefix string, keep func(key string) bool, maxKeys int) ([]string, bool, error) {
+	return ListS3Prefix(ctx, bucket, prefix, store.client, keep, maxKeys)
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"net/http"
+	"runtime"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Build info, set at build time with
+// go build -ldflags "-X main.gitCommit=$(git rev-parse HEAD) -X main.buildTime=$(date -u +%Y-%m-%dT%H:%M:%SZ)"
+var (
+	gitCommit = "unknown"
+	buildTime = "unknown"
+)
+
+// Report which build is running
+func Version(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{
+		"commit":     gitCommit,
+		"build_time": buildTime,
+		"go_version": runtime.Version(),
+	})
+}